@@ -0,0 +1,163 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+	fileutil "untislogger/Fileutil"
+	Logging "untislogger/Logging"
+)
+
+// Actions written to the audit log
+const (
+	AccountAdded     = "account.added"
+	AccountReplaced  = "account.replaced"
+	AccountRemoved   = "account.removed"
+	CredentialsUsed  = "credentials.decrypted"
+	UntisLoginFailed = "untis.login_failed"
+	WebLoginFailed   = "web.login_failed"
+	AdminCommand     = "admin.command"
+	KeysRotated      = "keys.rotated"
+)
+
+// Entry is one line of the audit log
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Actor   string    `json:"actor,omitempty"`   // who did it, e.g. a Discord user ID or an IP address
+	Account string    `json:"account,omitempty"` // the account it was done to
+	Detail  string    `json:"detail,omitempty"`
+}
+
+var logger = Logging.For("audit")
+
+var (
+	mutex     sync.Mutex
+	path      string
+	maxAge    time.Duration // how long entries are kept, 0 keeps them forever
+	lastPrune time.Time
+)
+
+// Open sets the file entries are appended to and how many days they are
+// kept, and removes entries past that. Before Open entries only go to the log.
+func Open(file string, retentionDays int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	path = file
+	maxAge = time.Duration(retentionDays) * 24 * time.Hour
+	prune(time.Now())
+}
+
+// Log appends an entry, errors are only logged so auditing never stops the bot.
+// Entries keep the wall-clock time on purpose, also under a fake clock or a
+// replay, as they record when the bot really did something.
+func Log(action, actor, account, detail string) {
+	entry := Entry{Time: time.Now(), Action: action, Actor: actor, Account: account, Detail: detail}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if path == "" {
+		logger.Info("Audit", "action", action, "actor", actor, "account", account, "detail", detail)
+		return
+	}
+	if entry.Time.Sub(lastPrune) > 24*time.Hour {
+		prune(entry.Time)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("Error writing audit log", "err", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logger.Error("Error writing audit log", "err", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		logger.Error("Error writing audit log", "err", err)
+	}
+}
+
+// the audit log is read backwards in chunks of this size
+const recentChunk = 64 * 1024
+
+// Recent returns the last n entries, newest first. The file is read from its
+// end, so only the chunks with these entries are read however long it gets.
+// Lines that can not be parsed are skipped.
+func Recent(n int) ([]Entry, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if path == "" || n <= 0 {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	end := info.Size()
+	var partial []byte // a line whose start is in the chunk before
+	for end > 0 && len(entries) < n {
+		size := min(recentChunk, end)
+		end -= size
+		chunk := make([]byte, size, int(size)+len(partial))
+		if _, err := f.ReadAt(chunk, end); err != nil {
+			return nil, err
+		}
+		lines := bytes.Split(append(chunk, partial...), []byte("\n"))
+		partial = nil
+		if end > 0 {
+			partial, lines = lines[0], lines[1:]
+		}
+		for i := len(lines) - 1; i >= 0 && len(entries) < n; i-- {
+			var entry Entry
+			if json.Unmarshal(lines[i], &entry) == nil {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// prune rewrites the file without the entries past the retention limit,
+// lines that can not be parsed are kept. mutex has to be held.
+func prune(now time.Time) {
+	lastPrune = now
+	if maxAge == 0 || path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("Error reading audit log", "err", err)
+		}
+		return
+	}
+	var kept bytes.Buffer
+	removed := 0
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		var entry Entry
+		if json.Unmarshal(line, &entry) == nil && now.Sub(entry.Time) > maxAge {
+			removed++
+			continue
+		}
+		kept.Write(line)
+	}
+	if removed == 0 {
+		return
+	}
+	if err := fileutil.WriteFile(path, kept.Bytes(), 0600); err != nil {
+		logger.Error("Error pruning audit log", "err", err)
+	}
+}
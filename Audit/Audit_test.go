@@ -0,0 +1,47 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecent(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	Open(file, 0)
+	defer Open("", 0)
+	if entries, err := Recent(5); err != nil || len(entries) != 0 {
+		t.Fatalf("Recent() without a file = %v, %v", entries, err)
+	}
+
+	// long entries, so the last ones span several chunks
+	detail := strings.Repeat("x", 1000)
+	for i := 0; i < 200; i++ {
+		Log(AdminCommand, "admin", fmt.Sprint(i), detail)
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not json\n")
+	f.Close()
+	Log(AccountRemoved, "admin", "200", "")
+
+	for _, n := range []int{1, 3, 150, 500} {
+		entries, err := Recent(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := min(n, 201)
+		if len(entries) != want {
+			t.Fatalf("Recent(%d) returned %d entries, want %d", n, len(entries), want)
+		}
+		for i, entry := range entries {
+			if entry.Account != fmt.Sprint(200-i) {
+				t.Fatalf("Recent(%d)[%d] is of account %s, want %d", n, i, entry.Account, 200-i)
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package Untis
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Kinds of timetable changes
+const (
+	ChangeAdded     = "added"
+	ChangeRemoved   = "removed"
+	ChangeCancelled = "cancelled"
+	ChangeChanged   = "changed"
+)
+
+type Change struct {
+	Kind     string               `json:"kind"`
+	LessonID int                  `json:"lessonId"`
+	Date     string               `json:"date"`
+	Start    string               `json:"startTime"`
+	Detected time.Time            `json:"detected"`
+	Old      *NamedTimetableEntry `json:"old,omitempty"`
+	New      *NamedTimetableEntry `json:"new,omitempty"`
+}
+
+// Diff compares two resolved timetables by lesson ID. Only days present in
+// both are compared, so a fetch for a different day is not reported as every
+// lesson being removed and added.
+func Diff(old, new []NamedTimetableEntry, detected time.Time) []Change {
+	oldDates := make(map[string]bool)
+	oldByID := make(map[int]NamedTimetableEntry)
+	for _, entry := range old {
+		oldDates[entry.Date] = true
+		oldByID[entry.ID] = entry
+	}
+	newDates := make(map[string]bool)
+	newByID := make(map[int]NamedTimetableEntry)
+	for _, entry := range new {
+		newDates[entry.Date] = true
+		newByID[entry.ID] = entry
+	}
+
+	var changes []Change
+	for _, entry := range new {
+		if !oldDates[entry.Date] {
+			continue
+		}
+		prev, ok := oldByID[entry.ID]
+		switch {
+		case !ok:
+			changes = append(changes, newChange(ChangeAdded, nil, &entry, detected))
+		case entry.Code == "cancelled" && prev.Code != "cancelled":
+			changes = append(changes, newChange(ChangeCancelled, &prev, &entry, detected))
+		case !sameLesson(prev, entry):
+			changes = append(changes, newChange(ChangeChanged, &prev, &entry, detected))
+		}
+	}
+	for _, entry := range old {
+		if !newDates[entry.Date] {
+			continue
+		}
+		if _, ok := newByID[entry.ID]; !ok {
+			changes = append(changes, newChange(ChangeRemoved, &entry, nil, detected))
+		}
+	}
+	return changes
+}
+
+func newChange(kind string, old, new *NamedTimetableEntry, detected time.Time) Change {
+	lesson := new
+	if lesson == nil {
+		lesson = old
+	}
+	return Change{
+		Kind:     kind,
+		LessonID: lesson.ID,
+		Date:     lesson.Date,
+		Start:    lesson.StartTime,
+		Detected: detected,
+		Old:      old,
+		New:      new,
+	}
+}
+
+// String describes the change in one line, e.g. "20-10-2025 08:00 changed: M R1 -> M R2"
+func (c Change) String() string {
+	describe := func(e *NamedTimetableEntry) string {
+		return strings.TrimSpace(strings.Join(e.Su, ", ") + " " + strings.Join(e.Ro, ", "))
+	}
+	text := fmt.Sprintf("%s %s %s", c.Date, c.Start, c.Kind)
+	switch {
+	case c.Old != nil && c.New != nil:
+		text += fmt.Sprintf(": %s -> %s", describe(c.Old), describe(c.New))
+	case c.New != nil:
+		text += ": " + describe(c.New)
+	case c.Old != nil:
+		text += ": " + describe(c.Old)
+	}
+	return text
+}
+
+func sameLesson(a, b NamedTimetableEntry) bool {
+	return a.Date == b.Date && a.StartTime == b.StartTime && a.EndTime == b.EndTime &&
+		a.Code == b.Code && slices.Equal(a.Su, b.Su) && slices.Equal(a.Ro, b.Ro) && slices.Equal(a.Kl, b.Kl)
+}
+
+// NextLesson returns the first lesson of the day of now that starts after now.
+func NextLesson(entries []NamedTimetableEntry, now time.Time) (NamedTimetableEntry, bool) {
+	today := now.Format("02-01-2006")
+	current := now.Format("15:04")
+	var next NamedTimetableEntry
+	found := false
+	for _, entry := range entries {
+		if entry.Date != today || entry.StartTime <= current {
+			continue
+		}
+		if !found || entry.StartTime < next.StartTime {
+			next = entry
+			found = true
+		}
+	}
+	return next, found
+}
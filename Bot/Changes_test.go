@@ -0,0 +1,95 @@
+package Untis
+
+import (
+	"testing"
+	"time"
+)
+
+func lesson(id int, date, start, subject, room string) NamedTimetableEntry {
+	return NamedTimetableEntry{ID: id, Date: date, StartTime: start, EndTime: start, Su: []string{subject}, Ro: []string{room}}
+}
+
+func TestDiff(t *testing.T) {
+	detected := time.Date(2025, 9, 1, 7, 0, 0, 0, time.UTC)
+	math := lesson(1, "01-09-2025", "07:45", "M", "A101")
+	german := lesson(2, "01-09-2025", "08:35", "D", "A102")
+	cancelled := math
+	cancelled.Code = "cancelled"
+	moved := math
+	moved.Ro = []string{"B202"}
+	tomorrow := lesson(3, "02-09-2025", "07:45", "E", "A101")
+
+	tests := []struct {
+		name     string
+		old, new []NamedTimetableEntry
+		want     []string // kinds of the changes, in order
+	}{
+		{"same", []NamedTimetableEntry{math, german}, []NamedTimetableEntry{math, german}, nil},
+		{"cancelled", []NamedTimetableEntry{math, german}, []NamedTimetableEntry{cancelled, german}, []string{ChangeCancelled}},
+		{"room changed", []NamedTimetableEntry{math}, []NamedTimetableEntry{moved}, []string{ChangeChanged}},
+		{"added", []NamedTimetableEntry{math}, []NamedTimetableEntry{math, german}, []string{ChangeAdded}},
+		{"removed", []NamedTimetableEntry{math, german}, []NamedTimetableEntry{german}, []string{ChangeRemoved}},
+		{"cancelled stays cancelled", []NamedTimetableEntry{cancelled}, []NamedTimetableEntry{cancelled}, nil},
+		{"other day is not compared", []NamedTimetableEntry{math, german}, []NamedTimetableEntry{tomorrow}, nil},
+		{"first fetch", nil, []NamedTimetableEntry{math}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := Diff(tt.old, tt.new, detected)
+			if len(changes) != len(tt.want) {
+				t.Fatalf("Diff() = %v, want kinds %v", changes, tt.want)
+			}
+			for i, c := range changes {
+				if c.Kind != tt.want[i] {
+					t.Errorf("change %d is %q, want %q", i, c.Kind, tt.want[i])
+				}
+				if !c.Detected.Equal(detected) {
+					t.Errorf("change %d detected at %s, want %s", i, c.Detected, detected)
+				}
+			}
+		})
+	}
+}
+
+func TestChangeString(t *testing.T) {
+	old := lesson(1, "01-09-2025", "07:45", "M", "A101")
+	new := old
+	new.Ro = []string{"B202"}
+	tests := []struct {
+		change Change
+		want   string
+	}{
+		{newChange(ChangeChanged, &old, &new, time.Time{}), "01-09-2025 07:45 changed: M A101 -> M B202"},
+		{newChange(ChangeAdded, nil, &new, time.Time{}), "01-09-2025 07:45 added: M B202"},
+		{newChange(ChangeRemoved, &old, nil, time.Time{}), "01-09-2025 07:45 removed: M A101"},
+	}
+	for _, tt := range tests {
+		if got := tt.change.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestNextLesson(t *testing.T) {
+	entries := []NamedTimetableEntry{
+		lesson(2, "01-09-2025", "08:35", "D", "A102"),
+		lesson(1, "01-09-2025", "07:45", "M", "A101"),
+		lesson(3, "02-09-2025", "07:45", "E", "A101"),
+	}
+	tests := []struct {
+		now    time.Time
+		wantID int
+		found  bool
+	}{
+		{time.Date(2025, 9, 1, 7, 0, 0, 0, time.Local), 1, true},
+		{time.Date(2025, 9, 1, 7, 45, 0, 0, time.Local), 2, true},
+		{time.Date(2025, 9, 1, 9, 0, 0, 0, time.Local), 0, false},
+		{time.Date(2025, 9, 3, 7, 0, 0, 0, time.Local), 0, false},
+	}
+	for _, tt := range tests {
+		next, found := NextLesson(entries, tt.now)
+		if found != tt.found || next.ID != tt.wantID {
+			t.Errorf("NextLesson(%s) = %d, %v, want %d, %v", tt.now.Format("02.01. 15:04"), next.ID, found, tt.wantID, tt.found)
+		}
+	}
+}
@@ -2,11 +2,11 @@ package Untis
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
-	"log"
 	"net/http"
-	"os"
+	Logging "untislogger/Logging"
 )
 
 type ClassesResponse struct {
@@ -28,19 +28,20 @@ type getClasses struct {
 	Jsonrpc string      `json:"jsonrpc"`
 }
 
-func Classes(cookies []*http.Cookie) {
+func Classes(ctx context.Context, cookies []*http.Cookie) ([]byte, error) {
+	ctx = Logging.With(ctx, "method", "getKlassen")
 	g := getClasses{"2023-05-06 15:44:22.215292", "getKlassen", map[string]interface{}{}, "2.0"}
 	ClassesJson, err := json.Marshal(g)
 	if err != nil {
-		log.Fatalf("Error marshaling login data: %v", err)
-		return
+		logger.ErrorContext(ctx, "Error marshaling request", "err", err)
+		return nil, err
 	}
 	classes := bytes.NewReader(ClassesJson)
 
-	prompt, err := http.NewRequest("POST", Url, classes)
+	prompt, err := http.NewRequestWithContext(ctx, "POST", Url, classes)
 	if err != nil {
-		log.Fatalf("Error creatingrequest: %v", err)
-		return
+		logger.ErrorContext(ctx, "Error creating request", "err", err)
+		return nil, err
 	}
 	//log.Println("prompt without extra header or cookie ", prompt)
 	//log.Println("Cookie: ", cookies)
@@ -55,32 +56,30 @@ func Classes(cookies []*http.Cookie) {
 		//}
 	}
 	//log.Println("Request JSON:", string(ClassesJson))
-	out, err := http.DefaultClient.Do(prompt)
+	out, err := call(prompt, "getKlassen")
 	if err != nil {
-		log.Printf("Error during request: %v", err)
-		return
+		logger.ErrorContext(ctx, "Error during request", "err", err)
+		return nil, err
 	}
 	defer out.Body.Close()
 	//log.Println(out.Status)
 	response, err := io.ReadAll(out.Body)
 	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return
+		logger.ErrorContext(ctx, "Error reading response body", "err", err)
+		return nil, err
 	}
 	//responseString := string(response)
 	//log.Println("Repsonse ", responseString)
 	var Response ClassesResponse
 	err = json.Unmarshal(response, &Response)
 	if err != nil {
-		log.Fatalf("Error unmarshaling response: %v", err)
+		logger.ErrorContext(ctx, "Error unmarshaling response", "err", err)
+		return nil, err
 	}
 	data, err := json.MarshalIndent(Response.Result, "", "  ")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	err = os.WriteFile("classes.json", data, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println("Updated Classes")
+	logger.InfoContext(ctx, "Updated classes")
+	return data, nil
 }
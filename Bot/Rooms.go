@@ -2,11 +2,11 @@ package Untis
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
-	"log"
 	"net/http"
-	"os"
+	Logging "untislogger/Logging"
 )
 
 type getRooms struct {
@@ -30,20 +30,21 @@ type Room struct {
 	Building string `json:"building"`
 }
 
-func Rooms(cookies []*http.Cookie) {
+func Rooms(ctx context.Context, cookies []*http.Cookie) ([]byte, error) {
+	ctx = Logging.With(ctx, "method", "getRooms")
 	//log.Println("Abrufen der Stunden")
 	g := getRooms{"2023-05-06 15:44:22.215292", "getRooms", map[string]interface{}{}, "2.0"}
 	roomsJson, err := json.Marshal(g)
 	if err != nil {
-		log.Fatalf("Error marshaling login data: %v", err)
-		return
+		logger.ErrorContext(ctx, "Error marshaling request", "err", err)
+		return nil, err
 	}
 	rooms := bytes.NewReader(roomsJson)
 
-	prompt, err := http.NewRequest("POST", Url, rooms)
+	prompt, err := http.NewRequestWithContext(ctx, "POST", Url, rooms)
 	if err != nil {
-		log.Fatalf("Error creatingrequest: %v", err)
-		return
+		logger.ErrorContext(ctx, "Error creating request", "err", err)
+		return nil, err
 	}
 	//log.Println("prompt without extra header or cookie ", prompt)
 	//log.Println("Cookie: ", cookies)
@@ -58,33 +59,31 @@ func Rooms(cookies []*http.Cookie) {
 		//}
 	}
 	//log.Println("Request JSON:", string(roomsJson))
-	out, err := http.DefaultClient.Do(prompt)
+	out, err := call(prompt, "getRooms")
 	if err != nil {
-		log.Printf("Error during request: %v", err)
-		return
+		logger.ErrorContext(ctx, "Error during request", "err", err)
+		return nil, err
 	}
 	defer out.Body.Close()
 	//log.Println(out.Status)
 	response, err := io.ReadAll(out.Body)
 	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return
+		logger.ErrorContext(ctx, "Error reading response body", "err", err)
+		return nil, err
 	}
 	//responseString := string(response)
 	//log.Println("Repsonse ", responseString)
 	var Response RoomsResponse
 	err = json.Unmarshal(response, &Response)
 	if err != nil {
-		log.Fatalf("Error unmarshaling response: %v", err)
+		logger.ErrorContext(ctx, "Error unmarshaling response", "err", err)
+		return nil, err
 	}
 
 	data, err := json.MarshalIndent(Response.Result, "", "  ")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	err = os.WriteFile("rooms.json", data, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println("Updated Rooms")
+	logger.InfoContext(ctx, "Updated rooms")
+	return data, nil
 }
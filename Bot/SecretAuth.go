@@ -0,0 +1,219 @@
+package Untis
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	Audit "untislogger/Audit"
+	Config "untislogger/Config"
+	Metrics "untislogger/Metrics"
+)
+
+// Credentials to log in to Untis with, either the password or the secret of
+// the WebUntis app login (the key in the QR code) is set
+type Credentials struct {
+	User     string
+	Password string
+	Secret   string
+}
+
+// Login logs in with the secret if there is one, else with the password
+func (c Credentials) Login(ctx context.Context) (Session, error) {
+	if c.Secret != "" {
+		return AuthSecret(ctx, c.User, c.Secret)
+	}
+	return Auth(ctx, c.User, c.Password)
+}
+
+// MainCredentials returns the credentials of the main account from the
+// untis section of the config
+func MainCredentials(cfg Config.Untis) Credentials {
+	return Credentials{User: cfg.User, Password: cfg.Password, Secret: cfg.Secret}
+}
+
+// QRCode is the content of the QR code WebUntis shows for logging in to the app
+type QRCode struct {
+	Server string // e.g. thalia.webuntis.com
+	School string
+	User   string
+	Secret string
+}
+
+// ParseQRCode parses a QR code link like
+// untis://setschool?url=thalia.webuntis.com&school=Mons_Tabor&user=name&key=SECRET
+func ParseQRCode(payload string) (QRCode, error) {
+	u, err := url.Parse(strings.TrimSpace(payload))
+	if err != nil || u.Scheme != "untis" {
+		return QRCode{}, errors.New("not an untis:// link")
+	}
+	q := u.Query()
+	code := QRCode{Server: q.Get("url"), School: q.Get("school"), User: q.Get("user"), Secret: q.Get("key")}
+	if code.User == "" || code.Secret == "" {
+		return QRCode{}, errors.New("the link has no user or key")
+	}
+	if _, err := TOTP(code.Secret, time.Now()); err != nil {
+		return QRCode{}, err
+	}
+	return code, nil
+}
+
+// School returns the server and school name the bot talks to, taken from Url
+func School() (server, school string) {
+	u, err := url.Parse(Url)
+	if err != nil {
+		return "", ""
+	}
+	return u.Host, u.Query().Get("school")
+}
+
+// TOTP returns the one time password of a base32 secret at t, the same the
+// Untis app generates (RFC 6238, SHA-1, 6 digits, 30 seconds)
+func TOTP(secret string, t time.Time) (int, error) {
+	secret = strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "="))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return 0, errors.New("the secret is not valid base32")
+	}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return int(code % 1000000), nil
+}
+
+// endpoint returns Url with the last path element replaced, e.g. by
+// jsonrpc_intern.do or api/app/config, and the given query
+func endpoint(path string, query url.Values) (string, error) {
+	u, err := url.Parse(Url)
+	if err != nil {
+		return "", err
+	}
+	u.Path = u.Path[:strings.LastIndex(u.Path, "/")+1] + path
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// AuthSecret logs in like the Untis app does, with a one time password made
+// from the secret of the QR code instead of the password of the user.
+func AuthSecret(ctx context.Context, user, secret string) (Session, error) {
+	now := clock.Now()
+	otp, err := TOTP(secret, now)
+	if err != nil {
+		return Session{}, err
+	}
+	_, school := School()
+	loginURL, err := endpoint("jsonrpc_intern.do", url.Values{"m": {"getUserData2017"}, "school": {school}, "v": {"i2.2"}})
+	if err != nil {
+		return Session{}, err
+	}
+	auth := map[string]interface{}{"clientTime": now.UnixMilli(), "user": user, "otp": otp}
+	body, err := json.Marshal(map[string]interface{}{
+		"id":      "2023-05-06 15:44:22.215292",
+		"method":  "getUserData2017",
+		"params":  []interface{}{map[string]interface{}{"auth": auth}},
+		"jsonrpc": "2.0",
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	out, err := post(ctx, loginURL, body, "getUserData2017")
+	var refused *RPCError
+	if errors.As(err, &refused) {
+		logger.WarnContext(ctx, "Untis refused the login", "user", user, "err", refused)
+		Audit.Log(Audit.UntisLoginFailed, "", "", "user "+user+" with app secret: "+refused.Error())
+		Metrics.AuthFailures.Inc("secret")
+		return Session{}, refused
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "Error during authentication", "user", user, "err", err)
+		return Session{}, err
+	}
+	defer out.Body.Close()
+	response, err := io.ReadAll(out.Body)
+	if err != nil {
+		return Session{}, err
+	}
+	var Response json.RawMessage
+	if err := json.Unmarshal(response, &Response); err != nil {
+		return Session{}, err
+	}
+
+	session := Session{Cookies: out.Cookies()}
+	for _, cookie := range session.Cookies {
+		if cookie.Name == "JSESSIONID" {
+			session.Login.SessionID = cookie.Value
+		}
+	}
+	if session.Login.SessionID == "" {
+		return Session{}, errors.New("untis returned no session")
+	}
+	if err := loadPerson(ctx, &session); err != nil {
+		Logout(ctx, session)
+		return Session{}, err
+	}
+	logger.InfoContext(ctx, "Login successful", "user", user)
+	return session, nil
+}
+
+// loadPerson asks the app config for the person the session belongs to,
+// getUserData2017 does not return it
+func loadPerson(ctx context.Context, session *Session) error {
+	configURL, err := endpoint("api/app/config", nil)
+	if err != nil {
+		return err
+	}
+	prompt, err := http.NewRequestWithContext(ctx, "GET", configURL, nil)
+	if err != nil {
+		return err
+	}
+	prompt.Header.Set("User-Agent", "Webuntis Test")
+	for _, cookie := range session.Cookies {
+		prompt.AddCookie(cookie)
+	}
+	out, err := call(prompt, "appConfig")
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+	if out.StatusCode != http.StatusOK {
+		return fmt.Errorf("untis app config: %s", out.Status)
+	}
+	var config struct {
+		Data struct {
+			LoginServiceConfig struct {
+				User struct {
+					PersonID int `json:"personId"`
+					Persons  []struct {
+						ID   int `json:"id"`
+						Type int `json:"type"`
+					} `json:"persons"`
+				} `json:"user"`
+			} `json:"loginServiceConfig"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(out.Body).Decode(&config); err != nil {
+		return err
+	}
+	user := config.Data.LoginServiceConfig.User
+	for _, person := range user.Persons {
+		if person.ID == user.PersonID {
+			session.Login.PersonID = person.ID
+			session.Login.PersonType = person.Type
+			return nil
+		}
+	}
+	return fmt.Errorf("untis app config has no person %d", user.PersonID)
+}
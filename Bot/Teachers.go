@@ -2,11 +2,11 @@ package Untis
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
-	"log"
 	"net/http"
-	"os"
+	Logging "untislogger/Logging"
 )
 
 type TeachersResponse struct {
@@ -28,19 +28,20 @@ type getTeachers struct {
 	Jsonrpc string      `json:"jsonrpc"`
 }
 
-func Teachers(cookies []*http.Cookie) {
+func Teachers(ctx context.Context, cookies []*http.Cookie) ([]byte, error) {
+	ctx = Logging.With(ctx, "method", "getTeachers")
 	g := getTeachers{"2023-05-06 15:44:22.215292", "getTeachers", map[string]interface{}{}, "2.0"}
 	TeachersJson, err := json.Marshal(g)
 	if err != nil {
-		log.Fatalf("Error marshaling login data: %v", err)
-		return
+		logger.ErrorContext(ctx, "Error marshaling request", "err", err)
+		return nil, err
 	}
 	teachers := bytes.NewReader(TeachersJson)
 
-	prompt, err := http.NewRequest("POST", Url, teachers)
+	prompt, err := http.NewRequestWithContext(ctx, "POST", Url, teachers)
 	if err != nil {
-		log.Fatalf("Error creatingrequest: %v", err)
-		return
+		logger.ErrorContext(ctx, "Error creating request", "err", err)
+		return nil, err
 	}
 	//log.Println("prompt without extra header or cookie ", prompt)
 	//log.Println("Cookie: ", cookies)
@@ -55,32 +56,30 @@ func Teachers(cookies []*http.Cookie) {
 		//}
 	}
 	//log.Println("Request JSON:", string(TeachersJson))
-	out, err := http.DefaultClient.Do(prompt)
+	out, err := call(prompt, "getTeachers")
 	if err != nil {
-		log.Printf("Error during request: %v", err)
-		return
+		logger.ErrorContext(ctx, "Error during request", "err", err)
+		return nil, err
 	}
 	defer out.Body.Close()
 	//log.Println(out.Status)
 	response, err := io.ReadAll(out.Body)
 	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return
+		logger.ErrorContext(ctx, "Error reading response body", "err", err)
+		return nil, err
 	}
 	//responseString := string(response)
 	//log.Println("Repsonse ", responseString)
 	var Response TeachersResponse
 	err = json.Unmarshal(response, &Response)
 	if err != nil {
-		log.Fatalf("Error unmarshaling response: %v", err)
+		logger.ErrorContext(ctx, "Error unmarshaling response", "err", err)
+		return nil, err
 	}
 	data, err := json.MarshalIndent(Response.Result, "", "  ")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	err = os.WriteFile("teachers.json", data, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println("Updated Teachers")
+	logger.InfoContext(ctx, "Updated teachers")
+	return data, nil
 }
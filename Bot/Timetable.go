@@ -2,12 +2,11 @@ package Untis
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"os"
 	"time"
 )
 
@@ -78,84 +77,90 @@ type Loginresult struct {
 	KlasseID   int    `json:"klasseId"`
 }
 
-func ReadLoginResultFromFile(path string) (Loginresult, error) {
-	var result Loginresult
-	data, err := os.ReadFile(path)
+func Timetable(ctx context.Context, session Session, st Storage, account string) error {
+	today := clock.Now()
+	Result, err := TimetableRange(ctx, session, today, today)
 	if err != nil {
-		return result, err
+		logger.ErrorContext(ctx, "Error fetching timetable", "err", err)
+		return err
 	}
-	err = json.Unmarshal(data, &result)
-	return result, err
+	logger.InfoContext(ctx, "Updated timetable")
+	subjects, rooms, classes := names(st)
+	if err := st.SaveTimetable(account, ResolveTimetable(Result, subjects, rooms, classes)); err != nil {
+		return err
+	}
+	logger.InfoContext(ctx, "Filled timetable")
+	return nil
 }
 
-func Timetable(cookies []*http.Cookie) {
-	loginResult, err := ReadLoginResultFromFile("login.json")
-	if err != nil {
-		log.Fatal(err)
-	}
-	today := time.Now().Format("20060102")
-	g := getTimetable{"2023-05-06 15:44:22.215292", "getTimetable", params{today, today, loginResult.PersonID, loginResult.PersonType}, "2.0"}
+// TimetableRange fetches the raw timetable of the logged in person for every
+// day from start to end (inclusive).
+func TimetableRange(ctx context.Context, session Session, start, end time.Time) ([]TimetableEntry, error) {
+	g := getTimetable{"2023-05-06 15:44:22.215292", "getTimetable", params{start.Format("20060102"), end.Format("20060102"), session.Login.PersonID, session.Login.PersonType}, "2.0"}
 	TimetablesJson, err := json.Marshal(g)
 	if err != nil {
-		log.Fatalf("Error marshaling login data: %v", err)
-		return
+		return nil, err
 	}
-	timetable := bytes.NewReader(TimetablesJson)
-
-	prompt, err := http.NewRequest("GET", Url, timetable)
+	prompt, err := http.NewRequestWithContext(ctx, "POST", Url, bytes.NewReader(TimetablesJson))
 	if err != nil {
-		log.Fatalf("Error creatingrequest: %v", err)
-		return
+		return nil, err
 	}
-	//log.Println("prompt without extra header or cookie ", prompt)
-	//log.Println("Cookie: ", cookies)
-
 	prompt.Header.Set("Content-Type", "application/json")
 	prompt.Header.Set("User-Agent", "Webuntis Test")
-
-	for _, cookie := range cookies {
-		//if cookie.Name == "JSESSIONID" {
+	for _, cookie := range session.Cookies {
 		prompt.AddCookie(cookie)
-		//log.Printf("Added JSESSIONID cookie: %s=%s", cookie.Name, cookie.Value)
-		//}
 	}
-	//log.Println("Request JSON:", string(TeachersJson))
-	out, err := http.DefaultClient.Do(prompt)
+	out, err := call(prompt, "getTimetable")
 	if err != nil {
-		log.Printf("Error during request: %v", err)
-		return
+		return nil, err
 	}
 	defer out.Body.Close()
-	//log.Println(out.Status)
 	response, err := io.ReadAll(out.Body)
 	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return
+		return nil, err
 	}
-	//responseString := string(response)
-	//log.Println("Repsonse ", responseString)
-	var Response TimetableResponse
-	err = json.Unmarshal(response, &Response)
-	if err != nil {
-		log.Fatalf("Error unmarshaling response: %v", err)
+	var Response struct {
+		Result []TimetableEntry `json:"result"`
+		Error  *RPCError        `json:"error,omitempty"`
 	}
-	data, err := json.MarshalIndent(Response.Result, "", "  ")
-	if err != nil {
-		log.Fatal(err)
+	if err := json.Unmarshal(response, &Response); err != nil {
+		return nil, err
 	}
-	err = os.WriteFile("timetable.json", data, 0644)
-	if err != nil {
-		log.Fatal(err)
+	if Response.Error != nil {
+		return nil, Response.Error
 	}
-	log.Println("Updated Timetable")
-	setTimetable()
+	return Response.Result, nil
 }
 
-func LoadIDMap(path string) (map[int]string, error) {
-	data, err := os.ReadFile(path)
+// FetchNamedTimetable logs in with the given credentials and returns the
+// resolved timetable from start to end. Names are taken from the master data
+// in st, master data that was never fetched is fetched with this session.
+func FetchNamedTimetable(ctx context.Context, st Storage, creds Credentials, start, end time.Time) ([]NamedTimetableEntry, error) {
+	session, err := creds.Login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer Logout(ctx, session)
+
+	for kind, fetch := range map[string]masterDataFetcher{"rooms": Rooms, "classes": Classes, "subjects": Subjects} {
+		if _, err := st.MasterData(kind); err == nil {
+			continue
+		}
+		if err := saveMasterData(ctx, st, kind, fetch, session); err != nil {
+			return nil, err
+		}
+	}
+
+	timetable, err := TimetableRange(ctx, session, start, end)
 	if err != nil {
 		return nil, err
 	}
+	subjects, rooms, classes := names(st)
+	return ResolveTimetable(timetable, subjects, rooms, classes), nil
+}
+
+// IDMap maps the IDs of master data (rooms, classes, ...) to their names
+func IDMap(data []byte) (map[int]string, error) {
 	var objs []NamedObj
 	if err := json.Unmarshal(data, &objs); err != nil {
 		return nil, err
@@ -166,17 +171,21 @@ func LoadIDMap(path string) (map[int]string, error) {
 	}
 	return m, nil
 }
-func LoadTimetable(path string) ([]TimetableEntry, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	var entries []TimetableEntry
-	if err := json.Unmarshal(data, &entries); err != nil {
-		return nil, err
+
+// names returns the ID maps of the subjects, rooms and classes in st, missing
+// master data gives an empty map
+func names(st Storage) (map[int]string, map[int]string, map[int]string) {
+	load := func(kind string) map[int]string {
+		data, err := st.MasterData(kind)
+		if err != nil {
+			return nil
+		}
+		m, _ := IDMap(data)
+		return m
 	}
-	return entries, nil
+	return load("subjects"), load("rooms"), load("classes")
 }
+
 func formatTime(t int) string {
 	h := t / 100
 	m := t % 100
@@ -189,12 +198,10 @@ func formatDate(date int) string {
 	day := s[6:8]
 	return fmt.Sprintf("%s-%s-%s", day, month, year)
 }
-func setTimetable() {
-	subjects, _ := LoadIDMap("subjects.json")
-	rooms, _ := LoadIDMap("rooms.json")
-	classes, _ := LoadIDMap("classes.json")
-	timetable, _ := LoadTimetable("timetable.json")
 
+// ResolveTimetable replaces the class, subject and room IDs of a raw
+// timetable with their names.
+func ResolveTimetable(timetable []TimetableEntry, subjects, rooms, classes map[int]string) []NamedTimetableEntry {
 	var namedTimetable []NamedTimetableEntry
 
 	for _, lesson := range timetable {
@@ -221,14 +228,5 @@ func setTimetable() {
 			ActivityType: lesson.ActivityType,
 		})
 	}
-
-	data, err := json.MarshalIndent(namedTimetable, "", "  ")
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = os.WriteFile("timetableFilled.json", data, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println("Filled Timetable")
+	return namedTimetable
 }
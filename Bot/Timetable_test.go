@@ -0,0 +1,258 @@
+package Untis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+	Mock "untislogger/Mock"
+)
+
+func TestFormatTime(t *testing.T) {
+	tests := []struct {
+		in   int
+		want string
+	}{
+		{745, "07:45"},
+		{1300, "13:00"},
+		{5, "00:05"},
+		{0, "00:00"},
+		{2359, "23:59"},
+	}
+	for _, tt := range tests {
+		if got := formatTime(tt.in); got != tt.want {
+			t.Errorf("formatTime(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	tests := []struct {
+		in   int
+		want string
+	}{
+		{20250901, "01-09-2025"},
+		{20251231, "31-12-2025"},
+		{20240229, "29-02-2024"},
+	}
+	for _, tt := range tests {
+		if got := formatDate(tt.in); got != tt.want {
+			t.Errorf("formatDate(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestResolveTimetable(t *testing.T) {
+	subjects := map[int]string{1: "M", 2: "D"}
+	rooms := map[int]string{10: "A101", 11: "A102"}
+	classes := map[int]string{100: "10a"}
+	tests := []struct {
+		name string
+		in   []TimetableEntry
+		want []NamedTimetableEntry
+	}{
+		{
+			name: "empty",
+			in:   nil,
+			want: nil,
+		},
+		{
+			name: "names and formats",
+			in: []TimetableEntry{{
+				ID: 1, Date: 20250901, StartTime: 745, EndTime: 830, Code: "cancelled", ActivityType: "Unterricht",
+				Kl: []IDObj{{100}}, Su: []IDObj{{1}}, Ro: []IDObj{{10}},
+			}},
+			want: []NamedTimetableEntry{{
+				ID: 1, Date: "01-09-2025", StartTime: "07:45", EndTime: "08:30", Code: "cancelled", ActivityType: "Unterricht",
+				Kl: []string{"10a"}, Su: []string{"M"}, Ro: []string{"A101"},
+			}},
+		},
+		{
+			name: "several rooms and unknown ids",
+			in: []TimetableEntry{{
+				ID: 2, Date: 20250902, StartTime: 1345, EndTime: 1430,
+				Su: []IDObj{{2}, {99}}, Ro: []IDObj{{10}, {11}},
+			}},
+			want: []NamedTimetableEntry{{
+				ID: 2, Date: "02-09-2025", StartTime: "13:45", EndTime: "14:30",
+				Su: []string{"D", ""}, Ro: []string{"A101", "A102"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ResolveTimetable(tt.in, subjects, rooms, classes)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ResolveTimetable() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIDMap(t *testing.T) {
+	got, err := IDMap([]byte(`[{"id": 1, "name": "A101", "longName": "Raum"}, {"id": 2, "name": "A102"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int]string{1: "A101", 2: "A102"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IDMap() = %v, want %v", got, want)
+	}
+	if _, err := IDMap([]byte(`{}`)); err == nil {
+		t.Error("IDMap() of an object did not fail")
+	}
+}
+
+// memoryStorage keeps what Main saves in memory
+type memoryStorage struct {
+	mutex      sync.Mutex
+	masterData map[string][]byte
+	timetables map[string][]NamedTimetableEntry
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{masterData: make(map[string][]byte), timetables: make(map[string][]NamedTimetableEntry)}
+}
+
+func (m *memoryStorage) MasterData(kind string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.masterData[kind]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return data, nil
+}
+
+func (m *memoryStorage) SaveMasterData(kind string, data []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.masterData[kind] = data
+	return nil
+}
+
+func (m *memoryStorage) SaveTimetable(account string, entries []NamedTimetableEntry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.timetables[account] = entries
+	return nil
+}
+
+// startMock runs the fake Untis server and points Url at it
+func startMock(t *testing.T, fixtures Mock.Fixtures, now func() time.Time) *Mock.Server {
+	t.Helper()
+	mock := Mock.New(fixtures, now)
+	server := httptest.NewServer(mock)
+	t.Cleanup(server.Close)
+	old := Url
+	Url = server.URL + "/WebUntis/jsonrpc.do?school=Test"
+	t.Cleanup(func() { Url = old })
+	return mock
+}
+
+// monday returns the Monday of the week of a fixed date, so the weekday
+// lessons of the fixtures are known
+func monday() time.Time {
+	return time.Date(2025, 9, 1, 7, 0, 0, 0, time.Local)
+}
+
+func TestFetchNamedTimetable(t *testing.T) {
+	fixtures := Mock.Fixtures{
+		Users:    []Mock.User{{Name: "anna", Password: "pw", PersonID: 1, PersonType: 5, KlasseID: 1}},
+		Rooms:    []Mock.Element{{ID: 1, Name: "A101"}, {ID: 2, Name: "B202"}},
+		Klassen:  []Mock.Element{{ID: 1, Name: "10a"}},
+		Subjects: []Mock.Element{{ID: 1, Name: "M"}, {ID: 2, Name: "D"}},
+		Lessons: []Mock.Lesson{
+			{ID: 1, Weekdays: []int{1}, StartTime: 745, EndTime: 830, Kl: []int{1}, Su: []int{1}, Ro: []int{1}},
+			{ID: 2, Weekdays: []int{2}, StartTime: 835, EndTime: 920, Kl: []int{1}, Su: []int{2}, Ro: []int{2}},
+		},
+	}
+	mock := startMock(t, fixtures, monday)
+	st := newMemoryStorage()
+	creds := Credentials{User: "anna", Password: "pw"}
+
+	entries, err := FetchNamedTimetable(context.Background(), st, creds, monday(), monday().AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []NamedTimetableEntry{
+		{ID: 1250901, Date: "01-09-2025", StartTime: "07:45", EndTime: "08:30", Kl: []string{"10a"}, Su: []string{"M"}, Ro: []string{"A101"}, ActivityType: "Unterricht"},
+		{ID: 2250902, Date: "02-09-2025", StartTime: "08:35", EndTime: "09:20", Kl: []string{"10a"}, Su: []string{"D"}, Ro: []string{"B202"}, ActivityType: "Unterricht"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("FetchNamedTimetable() = %+v, want %+v", entries, want)
+	}
+	if n := mock.Calls("logout"); n != 1 {
+		t.Errorf("logged out %d times, want 1", n)
+	}
+
+	if _, err := FetchNamedTimetable(context.Background(), st, Credentials{User: "anna", Password: "wrong"}, monday(), monday()); err == nil {
+		t.Error("FetchNamedTimetable() with a wrong password did not fail")
+	}
+}
+
+func TestFetchNamedTimetableWithSecret(t *testing.T) {
+	fixtures := Mock.Default()
+	startMock(t, fixtures, nil) // one time passwords use the real clock
+	entries, err := FetchNamedTimetable(context.Background(), newMemoryStorage(), Credentials{User: "app", Secret: "JBSWY3DPEHPK3PXP"}, monday(), monday())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the app user is in the other class, which has one lesson a day
+	if len(entries) != 1 || entries[0].Kl[0] != "10b" {
+		t.Errorf("FetchNamedTimetable() = %+v, want the one lesson of 10b", entries)
+	}
+}
+
+func TestFetchNamedTimetableFault(t *testing.T) {
+	fixtures := Mock.Default()
+	fixtures.Faults = []Mock.Fault{{Method: "getTimetable", Times: 1, Code: -7004, Message: "no allowed date"}}
+	startMock(t, fixtures, monday)
+	st := newMemoryStorage()
+	creds := Credentials{User: "demo", Password: "demo-password"}
+
+	_, err := FetchNamedTimetable(context.Background(), st, creds, monday(), monday())
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -7004 {
+		t.Fatalf("FetchNamedTimetable() error = %v, want the injected Untis error", err)
+	}
+	if _, err := FetchNamedTimetable(context.Background(), st, creds, monday(), monday()); err != nil {
+		t.Errorf("FetchNamedTimetable() after the fault = %v", err)
+	}
+}
+
+func TestMasterDataFault(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault Mock.Fault
+	}{
+		{"rpc error", Mock.Fault{Method: "getRooms", Times: 1, Code: -8520, Message: "not authenticated"}},
+		{"http error", Mock.Fault{Method: "getRooms", Times: 1, Status: http.StatusServiceUnavailable}},
+	}
+	for _, tt := range tests {
+		mock := startMock(t, Mock.Default(), monday)
+		st := newMemoryStorage()
+		creds := Credentials{User: "demo", Password: "demo-password"}
+		if err := Main(context.Background(), st, "main", creds); err != nil {
+			t.Fatal(err)
+		}
+		rooms, _ := st.MasterData("rooms")
+
+		mock.Inject(tt.fault)
+		err := Main(context.Background(), st, "main", creds)
+		if err == nil {
+			t.Errorf("%s: Main() succeeded although getRooms failed", tt.name)
+		}
+		var rpcErr *RPCError
+		if tt.fault.Code != 0 && (!errors.As(err, &rpcErr) || rpcErr.Code != tt.fault.Code) {
+			t.Errorf("%s: Main() error = %v, want the injected Untis error", tt.name, err)
+		}
+		if got, _ := st.MasterData("rooms"); !bytes.Equal(got, rooms) {
+			t.Errorf("%s: the rooms were overwritten with %s", tt.name, got)
+		}
+	}
+}
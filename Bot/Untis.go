@@ -2,13 +2,17 @@ package Untis
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"os"
-
-	"github.com/joho/godotenv"
+	"time"
+	Audit "untislogger/Audit"
+	Clock "untislogger/Clock"
+	Logging "untislogger/Logging"
+	Metrics "untislogger/Metrics"
 )
 
 type Params struct {
@@ -28,77 +32,207 @@ type LoginResponse struct {
 	Jsonrpc string      `json:"jsonrpc"`
 	ID      string      `json:"id"`
 	Result  Loginresult `json:"result"`
+	Error   *RPCError   `json:"error,omitempty"`
+}
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("untis error %d: %s", e.Code, e.Message)
 }
 
+var logger = Logging.For("untis")
+
+// Url is the JSON-RPC address of the school, set from the config at startup
 var Url = "https://thalia.webuntis.com/WebUntis/jsonrpc.do?school=Mons_Tabor"
 
+// Client sends the requests to Untis, its transport is replaced to record
+// or replay them
+var Client = http.DefaultClient
+
+var clock = Clock.Real // tells which day is today, set by SetClock
+
+// SetClock sets the clock that tells which day is fetched and the time of
+// app logins
+func SetClock(c Clock.Clock) {
+	clock = c
+}
+
 //var Password = os.Getenv("UNTIS_PASSWORD")
 //var USERS = os.Getenv("UNTIS_USER")
 
-func Main(user, password string) {
-	godotenv.Load("../.env")
-	cookies, err := Auth(user, password)
+// Storage keeps the master data and resolved timetables fetched by Main
+type Storage interface {
+	MasterData(kind string) ([]byte, error)
+	SaveMasterData(kind string, data []byte) error
+	SaveTimetable(account string, entries []NamedTimetableEntry) error
+}
+
+// Session is a logged in Untis session. It is only kept in memory, so
+// several accounts can be logged in at the same time.
+type Session struct {
+	Cookies []*http.Cookie
+	Login   Loginresult
+}
+
+// Main fetches the master data and today's timetable of the user and saves
+// them in st, the timetable under the given account.
+func Main(ctx context.Context, st Storage, account string, creds Credentials) error {
+	ctx = Logging.With(ctx, "account", account)
+	session, err := creds.Login(ctx)
 	if err != nil {
-		log.Fatal(err)
-		return
+		return err
+	}
+	defer Logout(ctx, session)
+
+	if err := saveMasterData(ctx, st, "rooms", Rooms, session); err != nil {
+		return err
 	}
-	Rooms(cookies)
 
-	Classes(cookies)
+	if err := saveMasterData(ctx, st, "classes", Classes, session); err != nil {
+		return err
+	}
 
-	Subjects(cookies)
+	if err := saveMasterData(ctx, st, "subjects", Subjects, session); err != nil {
+		return err
+	}
 
-	Timetable(cookies)
+	if err := Timetable(ctx, session, st, account); err != nil {
+		return err
+	}
 
 	//getTeachers sends empty response
-	Teachers(cookies)
+	return saveMasterData(ctx, st, "teachers", Teachers, session)
 }
 
-func Auth(user, password string) ([]*http.Cookie, error) {
+// masterDataFetcher is one of Rooms, Classes, Subjects and Teachers
+type masterDataFetcher func(ctx context.Context, cookies []*http.Cookie) ([]byte, error)
+
+func saveMasterData(ctx context.Context, st Storage, kind string, fetch masterDataFetcher, session Session) error {
+	data, err := fetch(ctx, session.Cookies)
+	if err != nil {
+		return err
+	}
+	return st.SaveMasterData(kind, data)
+}
+
+// Auth logs in to Untis. Nothing is written to disk, the session ID only
+// lives in the returned Session.
+func Auth(ctx context.Context, user, password string) (Session, error) {
 	l := Login{"2023-05-06 15:44:22.215292", "authenticate", Params{user, password, "WebUntis Test"}, "2.0"}
 	loginJSON, err := json.Marshal(l)
 	if err != nil {
-		log.Fatalf("Error marshaling login data: %v", err)
-		return nil, err
+		return Session{}, err
 	}
-	login := bytes.NewReader(loginJSON)
 
-	//log.Println("Run")
-	LoginOut, err := http.Post(Url, "application/json", login)
+	LoginOut, err := post(ctx, Url, loginJSON, "authenticate")
+	var refused *RPCError
+	if errors.As(err, &refused) {
+		logger.WarnContext(ctx, "Untis refused the login", "user", user, "err", refused)
+		Audit.Log(Audit.UntisLoginFailed, "", "", "user "+user+" with password: "+refused.Error())
+		Metrics.AuthFailures.Inc("password")
+		return Session{}, refused
+	}
 	if err != nil {
-		log.Printf("Error during authentication: %v", err)
-		return nil, err
+		logger.ErrorContext(ctx, "Error during authentication", "user", user, "err", err)
+		return Session{}, err
 	}
 	defer LoginOut.Body.Close()
 
 	// Parse cookies from response
 	cookies := LoginOut.Cookies()
-	//log.Println("Received cookies:", cookies)
-	//log.Println("Set-Cookie headers:", LoginOut.Header["Set-Cookie"])
-	//loginRespBody, _ := io.ReadAll(LoginOut.Body)
-	//log.Println("Login response body:", string(loginRespBody))
-
-	log.Println("Login successful")
 
-	//log.Println("Login successful")
 	response, err := io.ReadAll(LoginOut.Body)
 	if err != nil {
-		log.Fatalf("Error reading response body: %v", err)
+		return Session{}, err
 	}
 	var Response LoginResponse
 	err = json.Unmarshal(response, &Response)
 	if err != nil {
-		log.Fatalf("Error unmarshaling response: %v", err)
+		return Session{}, err
+	}
+	logger.InfoContext(ctx, "Login successful", "user", user)
+	return Session{Cookies: cookies, Login: Response.Result}, nil
+}
+
+// How long logging out may take, it is also done when ctx was cancelled
+const logoutTimeout = 5 * time.Second
+
+// Logout ends the Untis session. It still logs out when ctx was cancelled,
+// so a session is not left open on shutdown.
+func Logout(ctx context.Context, session Session) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), logoutTimeout)
+	defer cancel()
+	g := getRooms{"2023-05-06 15:44:22.215292", "logout", map[string]interface{}{}, "2.0"}
+	logoutJson, err := json.Marshal(g)
+	if err != nil {
+		return err
 	}
-	data, err := json.MarshalIndent(Response.Result, "", "  ")
+	prompt, err := http.NewRequestWithContext(ctx, "POST", Url, bytes.NewReader(logoutJson))
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	prompt.Header.Set("Content-Type", "application/json")
+	prompt.Header.Set("User-Agent", "Webuntis Test")
+	for _, cookie := range session.Cookies {
+		prompt.AddCookie(cookie)
 	}
-	err = os.WriteFile("login.json", data, 0644)
+	out, err := call(prompt, "logout")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	out.Body.Close()
+	return nil
+}
 
-	return cookies, nil
+// post sends a JSON body like http.Post, but stops when ctx is done
+func post(ctx context.Context, url string, body []byte, method string) (*http.Response, error) {
+	prompt, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	prompt.Header.Set("Content-Type", "application/json")
+	return call(prompt, method)
+}
 
+// call sends a request to Untis and records its duration and result in the
+// metrics. The body of the response is read here to see whether it holds a
+// JSON-RPC error, the returned response can be read as usual. A status other
+// than 2xx and a JSON-RPC error are returned as errors, the latter wrapping
+// the *RPCError.
+func call(prompt *http.Request, method string) (*http.Response, error) {
+	ctx := Logging.With(prompt.Context(), "method", method)
+	start := time.Now()
+	defer func() { Metrics.UntisRequestDuration.ObserveDuration(time.Since(start), method) }()
+	out, err := Client.Do(prompt)
+	if err != nil {
+		Metrics.UntisRequests.Inc(method, "error")
+		logger.WarnContext(ctx, "Untis request failed", "err", err)
+		return nil, err
+	}
+	body, err := io.ReadAll(out.Body)
+	out.Body.Close()
+	if err != nil {
+		Metrics.UntisRequests.Inc(method, "error")
+		logger.WarnContext(ctx, "Reading the Untis response failed", "err", err)
+		return nil, err
+	}
+	logger.DebugContext(ctx, "Untis request", "status", out.StatusCode, "took", time.Since(start))
+	out.Body = io.NopCloser(bytes.NewReader(body))
+
+	var rpc struct {
+		Error *RPCError `json:"error"`
+	}
+	switch {
+	case out.StatusCode < 200 || out.StatusCode > 299:
+		Metrics.UntisRequests.Inc(method, "http_error")
+		return nil, fmt.Errorf("untis answered %s with %s", method, out.Status)
+	case json.Unmarshal(body, &rpc) == nil && rpc.Error != nil:
+		Metrics.UntisRequests.Inc(method, "rpc_error")
+		return nil, fmt.Errorf("%s: %w", method, rpc.Error)
+	}
+	Metrics.UntisRequests.Inc(method, "ok")
+	return out, nil
 }
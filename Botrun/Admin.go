@@ -0,0 +1,374 @@
+package bot
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	Audit "untislogger/Audit"
+	Status "untislogger/Status"
+	Store "untislogger/Store"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const adminHelp = `Admin commands:
+!admin accounts - list the registered accounts
+!admin refresh [user] - fetch the timetable of a user, or of everyone, now
+!admin pause <user> / !admin resume <user> - turn the DMs of a user off or on
+!admin health - show failing fetches and notifiers
+!admin remove <user> - remove the account of a user and block them from adding a new one
+!admin unblock <user> - allow a blocked user to add an account again
+!admin role <@role|none> - set the role allowed to use these commands on this server
+!admin audit - show the latest audit log entries (bot operators only)`
+
+// isOperator reports whether a Discord user is listed in discord.admin_users.
+// Operators may use the admin commands for all accounts, also in DMs.
+func isOperator(userID string) bool {
+	for _, id := range conf.Discord.AdminUsers {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// isServerAdmin reports whether the author of m is the owner or an
+// administrator of the server m was sent in
+func isServerAdmin(s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	perms, err := s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	return err == nil && perms&discordgo.PermissionAdministrator != 0
+}
+
+// isAdmin reports whether the author of m may use the admin commands for the
+// server m was sent in: operators, server administrators and members with the
+// admin role of the server
+func isAdmin(s *discordgo.Session, m *discordgo.MessageCreate, guild Store.Guild) bool {
+	if isOperator(m.Author.ID) {
+		return true
+	}
+	if m.GuildID == "" {
+		return false
+	}
+	if guild.AdminRole != "" && m.Member != nil && slices.Contains(m.Member.Roles, guild.AdminRole) {
+		return true
+	}
+	return isServerAdmin(s, m)
+}
+
+// reply sends the answer to an admin command as a DM, so account details are
+// not posted into a server channel
+func reply(s *discordgo.Session, userID, text string) {
+	channel, err := s.UserChannelCreate(userID)
+	if err != nil {
+		logger.Error("Error creating DM channel", "err", err)
+		return
+	}
+	for len(text) > 1900 { // Discord messages are limited to 2000 characters
+		cut := strings.LastIndex(text[:1900], "\n")
+		if cut <= 0 {
+			cut = 1900
+		}
+		s.ChannelMessageSend(channel.ID, text[:cut])
+		text = strings.TrimLeft(text[cut:], "\n")
+	}
+	s.ChannelMessageSend(channel.ID, text)
+}
+
+var userArg = regexp.MustCompile(`^<@!?(\d+)>$|^(\d+)$`)
+
+// parseUser returns the user ID of a mention or plain ID
+func parseUser(arg string) (string, bool) {
+	match := userArg.FindStringSubmatch(arg)
+	if match == nil {
+		return "", false
+	}
+	return match[1] + match[2], true
+}
+
+// inScope reports whether an admin of guildID may manage acc, an empty
+// guildID means all accounts
+func inScope(acc Account, guildID string) bool {
+	return guildID == "" || acc.GuildID == guildID
+}
+
+// handleAdmin runs an !admin command
+func handleAdmin(s *discordgo.Session, m *discordgo.MessageCreate) {
+	var guild Store.Guild
+	if m.GuildID != "" {
+		var err error
+		if guild, err = db.Guild(m.GuildID); err != nil {
+			logger.Error("Error loading guild settings", "err", err)
+			return
+		}
+	}
+	if !isAdmin(s, m, guild) {
+		s.ChannelMessageSend(m.ChannelID, "You are not allowed to use the admin commands.")
+		return
+	}
+	Audit.Log(Audit.AdminCommand, m.Author.ID, "", m.Content)
+
+	// operators manage every account, everyone else only those of their server
+	scope := m.GuildID
+	if isOperator(m.Author.ID) {
+		scope = ""
+	}
+	args := strings.Fields(m.Content)[1:]
+	if len(args) == 0 {
+		reply(s, m.Author.ID, adminHelp)
+		return
+	}
+	cmd, args := args[0], args[1:]
+
+	// commands taking a user
+	var target Account
+	switch cmd {
+	case "pause", "resume", "remove", "unblock", "refresh":
+		if len(args) == 0 {
+			if cmd == "refresh" {
+				break
+			}
+			reply(s, m.Author.ID, "Usage: !admin "+cmd+" <user>")
+			return
+		}
+		userID, ok := parseUser(args[0])
+		if !ok {
+			reply(s, m.Author.ID, args[0]+" is not a user mention or ID.")
+			return
+		}
+		acc, found := accountByUserID(userID)
+		if cmd == "unblock" {
+			target = Account{UserID: userID}
+			break
+		}
+		if !found || !inScope(acc, scope) {
+			reply(s, m.Author.ID, "There is no account of <@"+userID+"> you can manage.")
+			return
+		}
+		target = acc
+	}
+
+	switch cmd {
+	case "accounts":
+		listAccounts(s, m.Author.ID, scope)
+	case "refresh":
+		if target.UserID == "" {
+			n := 0
+			for _, acc := range loadAllAccounts() {
+				if inScope(acc, scope) && submitFetch(acc) {
+					n++
+				}
+			}
+			reply(s, m.Author.ID, fmt.Sprintf("Fetching %d accounts.", n))
+		} else if submitFetch(target) {
+			reply(s, m.Author.ID, "Fetching the timetable of <@"+target.UserID+">.")
+		} else {
+			reply(s, m.Author.ID, "The timetable of <@"+target.UserID+"> is already being fetched.")
+		}
+	case "pause", "resume":
+		prefs, err := db.Preferences(target.UserID)
+		if err == nil {
+			prefs.Paused = cmd == "pause"
+			err = db.SavePreferences(target.UserID, prefs)
+		}
+		if err != nil {
+			logger.Error("Error saving preferences", "err", err)
+			reply(s, m.Author.ID, "The settings could not be saved.")
+			return
+		}
+		if prefs.Paused {
+			reply(s, m.Author.ID, "Notifications of <@"+target.UserID+"> are paused.")
+		} else {
+			reply(s, m.Author.ID, "Notifications of <@"+target.UserID+"> are on again.")
+		}
+	case "health":
+		sendHealth(s, m.Author.ID, scope)
+	case "remove":
+		removeUser(s, m.Author.ID, target)
+	case "unblock":
+		setBlocked(s, m.Author.ID, scope, m.GuildID, target.UserID, false)
+	case "role":
+		setAdminRole(s, m, guild, args)
+	case "audit":
+		if !isOperator(m.Author.ID) {
+			reply(s, m.Author.ID, "Only bot operators can see the audit log.")
+			return
+		}
+		sendAuditLog(s, m.Author.ID)
+	default:
+		reply(s, m.Author.ID, adminHelp)
+	}
+}
+
+func listAccounts(s *discordgo.Session, adminID, scope string) {
+	var b strings.Builder
+	n := 0
+	for _, acc := range loadAllAccounts() {
+		if !inScope(acc, scope) {
+			continue
+		}
+		n++
+		login := "password"
+		if acc.Secret != "" {
+			login = "app secret"
+		}
+		prefs, _ := db.Preferences(acc.UserID)
+		fetch, _ := Status.FetchOf(acc.UserID)
+		line := fmt.Sprintf("<@%s> Untis user %s, %s", acc.UserID, acc.Username, login)
+		if prefs.Paused {
+			line += ", paused"
+		}
+		switch {
+		case fetch.Failing:
+			line += ", failing: " + fetch.LastError
+		case !fetch.LastSuccess.IsZero():
+			line += ", fetched " + fetch.LastSuccess.Format("02.01. 15:04")
+		}
+		b.WriteString(line + "\n")
+	}
+	if n == 0 {
+		reply(s, adminID, "There are no accounts.")
+		return
+	}
+	reply(s, adminID, fmt.Sprintf("%d accounts:\n%s", n, b.String()))
+}
+
+func sendHealth(s *discordgo.Session, adminID, scope string) {
+	var b strings.Builder
+	if keys == nil {
+		b.WriteString("No encryption key is configured, accounts are disabled.\n")
+	}
+	queue := Status.QueueState()
+	fmt.Fprintf(&b, "Fetch queue: %d waiting, %d running, %d skipped.\n", queue.Waiting, queue.Running, queue.Skipped)
+	failing := 0
+	for _, acc := range loadAllAccounts() {
+		if !inScope(acc, scope) {
+			continue
+		}
+		if fetch, ok := Status.FetchOf(acc.UserID); ok && fetch.Failing {
+			failing++
+			fmt.Fprintf(&b, "<@%s> failing: %s\n", acc.UserID, fetch.LastError)
+		}
+	}
+	if failing == 0 {
+		b.WriteString("No failing fetches.\n")
+	}
+	for _, n := range Status.Notifiers() {
+		if n.Failing {
+			fmt.Fprintf(&b, "Notifier %s is failing: %s\n", n.Name, n.LastError)
+		} else {
+			fmt.Fprintf(&b, "Notifier %s ok, last sent %s\n", n.Name, n.LastSent.Format("02.01. 15:04"))
+		}
+	}
+	reply(s, adminID, b.String())
+}
+
+// removeUser removes the account of a user and blocks them on the server the
+// account was added in
+func removeUser(s *discordgo.Session, adminID string, acc Account) {
+	if err := RemoveAccount(acc.UserID, adminID); err != nil {
+		logger.Error("Error removing account", "err", err)
+		reply(s, adminID, "The account could not be removed.")
+		return
+	}
+	if acc.GuildID != "" {
+		setBlocked(s, adminID, "", acc.GuildID, acc.UserID, true)
+		return
+	}
+	reply(s, adminID, "The account of <@"+acc.UserID+"> was removed.")
+}
+
+// setBlocked blocks or unblocks a user from adding accounts in guildID
+func setBlocked(s *discordgo.Session, adminID, scope, guildID, userID string, blocked bool) {
+	if guildID == "" || !inScope(Account{GuildID: guildID}, scope) {
+		reply(s, adminID, "Use this command on the server the user should be unblocked on.")
+		return
+	}
+	guild, err := db.Guild(guildID)
+	if err == nil {
+		guild.Blocked = slices.DeleteFunc(guild.Blocked, func(id string) bool { return id == userID })
+		if blocked {
+			guild.Blocked = append(guild.Blocked, userID)
+		}
+		err = db.SaveGuild(guild)
+	}
+	if err != nil {
+		logger.Error("Error saving guild settings", "err", err)
+		reply(s, adminID, "The settings could not be saved.")
+		return
+	}
+	if blocked {
+		reply(s, adminID, "The account of <@"+userID+"> was removed and they can not add a new one, use !admin unblock to allow it again.")
+	} else {
+		reply(s, adminID, "<@"+userID+"> can add an account again.")
+	}
+}
+
+// setAdminRole sets the admin role of the server, only server administrators
+// and operators may do that
+func setAdminRole(s *discordgo.Session, m *discordgo.MessageCreate, guild Store.Guild, args []string) {
+	if m.GuildID == "" {
+		reply(s, m.Author.ID, "Use this command on the server the role belongs to.")
+		return
+	}
+	if !isOperator(m.Author.ID) && !isServerAdmin(s, m) {
+		reply(s, m.Author.ID, "Only server administrators can set the admin role.")
+		return
+	}
+	switch {
+	case len(m.MentionRoles) > 0:
+		guild.AdminRole = m.MentionRoles[0]
+	case len(args) > 0 && args[0] == "none":
+		guild.AdminRole = ""
+	default:
+		reply(s, m.Author.ID, "Usage: !admin role <@role|none>")
+		return
+	}
+	if err := db.SaveGuild(guild); err != nil {
+		logger.Error("Error saving guild settings", "err", err)
+		reply(s, m.Author.ID, "The settings could not be saved.")
+		return
+	}
+	if guild.AdminRole == "" {
+		reply(s, m.Author.ID, "Only server administrators can use the admin commands now.")
+	} else {
+		reply(s, m.Author.ID, "Members with <@&"+guild.AdminRole+"> can use the admin commands now.")
+	}
+}
+
+// isBlocked reports whether a user may not add accounts in guildID
+func isBlocked(guildID, userID string) bool {
+	guild, err := db.Guild(guildID)
+	if err != nil {
+		logger.Error("Error loading guild settings", "err", err)
+		return false
+	}
+	return slices.Contains(guild.Blocked, userID)
+}
+
+// Send the latest audit log entries as a DM
+func sendAuditLog(s *discordgo.Session, userID string) {
+	entries, err := Audit.Recent(20)
+	if err != nil {
+		logger.Error("Error reading audit log", "err", err)
+		reply(s, userID, "The audit log could not be read.")
+		return
+	}
+	var b strings.Builder
+	b.WriteString("Latest audit log entries:\n")
+	for _, e := range entries {
+		line := fmt.Sprintf("`%s` %s", e.Time.Format("02.01. 15:04:05"), e.Action)
+		if e.Actor != "" {
+			line += " by " + e.Actor
+		}
+		if e.Account != "" {
+			line += " on " + e.Account
+		}
+		if e.Detail != "" {
+			line += ": " + e.Detail
+		}
+		b.WriteString(line + "\n")
+	}
+	reply(s, userID, b.String())
+}
@@ -1,257 +1,478 @@
 package bot
 
 import (
-	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
-	"io"
-	"os"
-	"os/signal"
+	"net/url"
+	"strings"
 	"sync"
-	"syscall"
 	"time"
 
-	"github.com/joho/godotenv"
+	Audit "untislogger/Audit"
+	Untis "untislogger/Bot"
+	Clock "untislogger/Clock"
+	Config "untislogger/Config"
+	History "untislogger/History"
+	Logging "untislogger/Logging"
+	Metrics "untislogger/Metrics"
+	Notify "untislogger/Notify"
+	Pool "untislogger/Pool"
+	Secrets "untislogger/Secrets"
+	Status "untislogger/Status"
+	Store "untislogger/Store"
 
 	"github.com/bwmarrin/discordgo"
 )
 
-// Account structure to save in JSON
-type Account struct {
-	UserID   string `json:"user_id"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-}
+// Account structure to save in the store
+type Account = Store.Account
 
 // State management for conversation steps
 type UserState struct {
-	Step     string // "awaiting_username", "awaiting_password"
+	Step     string // "awaiting_username", "awaiting_password", "awaiting_secret"
 	Username string // Temporary storage for username until password is received
+	GuildID  string // the server !addaccount was used in
+	Secret   bool   // !addaccount secret, the key of the QR code is asked instead of the password
+}
+
+var (
+	userStates = make(map[string]*UserState) // userID -> state
+	stateMutex sync.Mutex                    // protect userStates
+	db         Store.Store                   // set by SetStore
+)
+
+var keys *Secrets.Keyring // the keys passwords are encrypted with, nil disables accounts
+
+var conf = Config.Default() // set by Start
+
+var logger = Logging.For("bot")
+
+var rootCtx = context.Background() // cancelled on shutdown, set by Start
+
+var clock = Clock.Real // set by SetClock
+
+// SetClock sets the clock of the scheduled fetches and of the changes they find
+func SetClock(c Clock.Clock) {
+	clock = c
 }
 
+// SetKeys sets the keys passwords are encrypted with, call it before Start.
+// Without keys no accounts can be added or fetched.
+func SetKeys(k *Secrets.Keyring) {
+	keys = k
+}
+
+// purpose of the credentials of the fetches run every check_interval
+const scheduledFetch = "scheduled fetch"
+
 var (
-	userStates   = make(map[string]*UserState) // userID -> state
-	stateMutex   sync.Mutex                    // protect userStates
-	accountsFile = "accounts.json"
+	auditedFetches = make(map[string]string) // account -> day its scheduled fetch was last audited
+	auditMutex     sync.Mutex
 )
 
-var encryptionKey []byte
+// auditCredentials writes a decryption to the audit log. Scheduled fetches
+// run every check_interval, only the first one of a day is written per account.
+func auditCredentials(acc Account, purpose string) {
+	if purpose == scheduledFetch {
+		day := clock.Now().Format("2006-01-02")
+		auditMutex.Lock()
+		seen := auditedFetches[acc.UserID] == day
+		auditedFetches[acc.UserID] = day
+		auditMutex.Unlock()
+		if seen {
+			return
+		}
+		purpose += ", the first today"
+	}
+	Audit.Log(Audit.CredentialsUsed, "", acc.UserID, purpose)
+}
 
-func init() {
-	godotenv.Load(".env")
-	keyStr := os.Getenv("ENC_KEY")
-	if keyStr == "" {
-		panic("ENC_KEY environment variable not set")
+// credentials decrypts the password or app secret of an account for the
+// given purpose, which is written to the audit log. One
+// encrypted by an older version or with an old key is re-encrypted right
+// away, bound to its account.
+func credentials(acc Account, purpose string) (Untis.Credentials, error) {
+	if keys == nil {
+		return Untis.Credentials{}, Secrets.ErrNoKeys
+	}
+	auditCredentials(acc, purpose)
+	creds := Untis.Credentials{User: acc.Username}
+	var err error
+	if acc.Secret != "" {
+		creds.Secret, err = keys.Secret(acc)
+	} else {
+		creds.Password, err = keys.Password(acc)
 	}
-	key, err := base64.StdEncoding.DecodeString(keyStr)
 	if err != nil {
-		panic("ENC_KEY is not valid base64")
+		return Untis.Credentials{}, err
 	}
-	if len(key) != 32 {
-		panic("ENC_KEY must be exactly 32 bytes after base64 decoding")
+	Logging.SetSecrets(acc.UserID, creds.Password, creds.Secret)
+	if !keys.CurrentAccount(acc) {
+		err := db.UpdateAccounts(func(accounts []Account) error {
+			for i := range accounts {
+				// leave it alone if it was replaced in the meantime
+				if accounts[i] == acc {
+					return keys.Reencrypt(&accounts[i])
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Error("Error upgrading password encryption", "account", acc.UserID, "err", err)
+		} else {
+			Audit.Log(Audit.CredentialsUsed, "", acc.UserID, purpose+", re-encrypted with key "+keys.Primary())
+			if err := keys.CheckLegacy(db); err != nil {
+				logger.Error("Error checking for passwords in the old formats", "err", err)
+			}
+		}
 	}
-	encryptionKey = key
+	return creds, nil
 }
 
-func encrypt(text string) (string, error) {
-	block, err := aes.NewCipher(encryptionKey)
+// saveAccount saves the account a Discord user added in guildID, it logs in
+// with secret when one is given and with password otherwise
+func saveAccount(userID, guildID, username, password, secret string) error {
+	Logging.SetSecrets(userID, password, secret)
+	// Keep the calendar feed token of an account that is replaced
+	prev, found, err := Store.FindAccount(db, userID)
 	if err != nil {
-		return "", err
+		return err
+	}
+	feedToken := prev.FeedToken
+	if !found || feedToken == "" {
+		if feedToken, err = Store.NewToken(); err != nil {
+			return err
+		}
+	}
+
+	if keys == nil {
+		return Secrets.ErrNoKeys
+	}
+	acc := Account{
+		UserID:    userID,
+		Username:  username,
+		FeedToken: feedToken,
+		GuildID:   guildID,
+	}
+	// Encrypt the password or secret before saving, only one of them is kept
+	if secret != "" {
+		err = keys.SetSecret(&acc, secret)
+	} else {
+		err = keys.SetPassword(&acc, password)
 	}
-	aesGCM, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if err := db.SaveAccount(acc); err != nil {
+		return err
 	}
-	nonce := make([]byte, aesGCM.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", err
+	action, kind := Audit.AccountAdded, "password"
+	if found {
+		action = Audit.AccountReplaced
 	}
-	ciphertext := aesGCM.Seal(nonce, nonce, []byte(text), nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	if secret != "" {
+		kind = "app secret"
+	}
+	Audit.Log(action, userID, userID, "with "+kind+" for "+username)
+	return nil
 }
 
-func decrypt(encrypted string) (string, error) {
-	data, err := base64.StdEncoding.DecodeString(encrypted)
-	if err != nil {
-		return "", err
+// FeedAccount returns the account owning the calendar feed token, its
+// credentials are only decrypted by AccountCredentials when they are needed
+func FeedAccount(token string) (Account, bool) {
+	if token == "" {
+		return Account{}, false
 	}
-	block, err := aes.NewCipher(encryptionKey)
-	if err != nil {
-		return "", err
+	for _, acc := range loadAllAccounts() {
+		if subtle.ConstantTimeCompare([]byte(acc.FeedToken), []byte(token)) == 1 {
+			return acc, true
+		}
 	}
-	aesGCM, err := cipher.NewGCM(block)
+	return Account{}, false
+}
+
+// feedURL returns the public calendar feed link for an account, empty if
+// http.public_url is not configured
+func feedURL(acc Account) string {
+	base := strings.TrimRight(conf.HTTP.PublicURL, "/")
+	if base == "" || acc.FeedToken == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/ical/%s.ics", base, acc.FeedToken)
+}
+
+func accountByUserID(userID string) (Account, bool) {
+	acc, found, err := Store.FindAccount(db, userID)
 	if err != nil {
-		return "", err
+		logger.Error("Error loading accounts", "err", err)
+	}
+	return acc, found
+}
+
+// Accounts returns all registered accounts with the passwords left out
+func Accounts() []Account {
+	accounts := loadAllAccounts()
+	for i := range accounts {
+		accounts[i].Password = ""
+		accounts[i].Secret = ""
+		accounts[i].FeedToken = ""
 	}
-	nonceSize := aesGCM.NonceSize()
-	if len(data) < nonceSize {
-		return "", errors.New("ciphertext too short")
+	return accounts
+}
+
+// LookupAccount returns the account of a user without decrypting anything
+func LookupAccount(userID string) (Account, bool) {
+	return accountByUserID(userID)
+}
+
+// AccountCredentials decrypts the credentials of an account found with
+// LookupAccount or FeedAccount, purpose is written to the audit log
+func AccountCredentials(acc Account, purpose string) (Untis.Credentials, error) {
+	return credentials(acc, purpose)
+}
+
+// Credentials returns the account of a user together with its decrypted
+// credentials, purpose is written to the audit log
+func Credentials(userID, purpose string) (Account, Untis.Credentials, bool) {
+	acc, ok := accountByUserID(userID)
+	if !ok {
+		return Account{}, Untis.Credentials{}, false
 	}
-	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
+	creds, err := credentials(acc, purpose)
 	if err != nil {
-		return "", err
+		logger.Error("Error decrypting password", "account", acc.UserID, "err", err)
+		return Account{}, Untis.Credentials{}, false
 	}
-	return string(plaintext), nil
+	return acc, creds, true
 }
 
-// Save account info to JSON file (appends or updates)
-func saveAccount(userID, username, password string) error {
-	var accounts []Account
+// Send a Discord message mentioning the user
+func sendLessonNotification(userID, username, message string) {
+	prefs, err := db.Preferences(userID)
+	if err != nil {
+		logger.Error("Error loading preferences", "err", err)
+	}
+	if prefs.Paused || !conf.Notifiers.DirectMessages {
+		return
+	}
+	Notify.Send("dm", userID, fmt.Sprintf("**%s**: %s", username, message))
+}
 
-	// Load existing accounts if file exists
-	if data, err := os.ReadFile(accountsFile); err == nil && len(data) > 0 {
-		_ = json.Unmarshal(data, &accounts)
+// Deliver a DM from the outbox
+func sendDM(ctx context.Context, userID, content string) error {
+	if DiscordSession == nil {
+		return errors.New("not connected to Discord")
 	}
+	return dm(ctx, DiscordSession, userID, content)
+}
 
-	// Remove any account with the same userID
-	newAccounts := accounts[:0]
-	for _, acc := range accounts {
-		if acc.UserID != userID {
-			newAccounts = append(newAccounts, acc)
+// SendDM sends a DM right away instead of through the outbox. When the bot is
+// not running it connects with token just for this message.
+func SendDM(ctx context.Context, token, userID, content string) error {
+	s := DiscordSession
+	if s == nil {
+		if token == "" {
+			return errors.New("discord.token (DISCORD_BOT_TOKEN) is not set")
+		}
+		var err error
+		if s, err = discordgo.New("Bot " + token); err != nil {
+			return err
 		}
 	}
-	accounts = newAccounts
+	return dm(ctx, s, userID, content)
+}
 
-	// Encrypt the password before saving
-	encPwd, err := encrypt(password)
+func dm(ctx context.Context, s *discordgo.Session, userID, content string) error {
+	channel, err := s.UserChannelCreate(userID, discordgo.WithContext(ctx))
 	if err != nil {
 		return err
 	}
-	accounts = append(accounts, Account{
-		UserID:   userID,
-		Username: username,
-		Password: encPwd,
-	})
+	_, err = s.ChannelMessageSend(channel.ID, content, discordgo.WithContext(ctx))
+	return err
+}
 
-	// Save back to file
-	newData, err := json.MarshalIndent(accounts, "", "  ")
-	if err != nil {
-		return err
-	}
-	if err := os.WriteFile(accountsFile, newData, 0644); err != nil {
-		return err
-	}
+var removedHooks []func(userID string) // set by OnRemove
 
-	// Ensure timetable files exist for this user
-	timetableFile := getTimetableFile(userID)
-	timetableFilledFile := getTimetableFilledFile(userID)
-	if _, err := os.Stat(timetableFile); os.IsNotExist(err) {
-		os.WriteFile(timetableFile, []byte("[]"), 0644)
+// OnRemove calls f with the user ID whenever an account is removed, e.g. to
+// drop what was cached for it. Call it before Start.
+func OnRemove(f func(userID string)) {
+	removedHooks = append(removedHooks, f)
+}
+
+// RemoveAccount removes the account of a user, actor is written to the audit log
+func RemoveAccount(userID, actor string) error {
+	if err := db.RemoveAccount(userID); err != nil {
+		return err
 	}
-	if _, err := os.Stat(timetableFilledFile); os.IsNotExist(err) {
-		os.WriteFile(timetableFilledFile, []byte("[]"), 0644)
+	Audit.Log(Audit.AccountRemoved, actor, userID, "by an admin")
+	auditMutex.Lock()
+	delete(auditedFetches, userID)
+	auditMutex.Unlock()
+	Logging.RemoveSecrets(userID)
+	for _, f := range removedHooks {
+		f(userID)
 	}
-
 	return nil
 }
 
-// Helper functions for per-user timetable files
-func getTimetableFile(userID string) string {
-	return fmt.Sprintf("timetable_%s.json", userID)
+// CheckAccount fetches today's timetable of user like the scheduled fetches
+// do, stores it under user.UserID and DMs the changes. It returns their number.
+func CheckAccount(user Account, creds Untis.Credentials) int {
+	return checkTimetableChangesForUser(user, creds)
 }
 
-func getTimetableFilledFile(userID string) string {
-	return fmt.Sprintf("timetableFilled_%s.json", userID)
-}
+// Check for timetable changes for a user and notify if changed
+func checkTimetableChangesForUser(user Account, creds Untis.Credentials) int {
+	today := clock.Now()
+	start := time.Now()
+	ctx := Logging.With(rootCtx, "account", user.UserID)
+	entries, err := Untis.FetchNamedTimetable(ctx, db, creds, today, today)
+	Status.RecordFetch(user.UserID, time.Since(start), err)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error fetching timetable", "err", err)
+		return 0
+	}
+	if err := db.SaveTimetable(user.UserID, entries); err != nil {
+		logger.ErrorContext(ctx, "Error saving timetable", "err", err)
+	}
 
-// Send a Discord message mentioning the user
-func sendLessonNotification(s *discordgo.Session, userID, username, message string) {
-	// Send a DM to the user
-	channel, err := s.UserChannelCreate(userID)
+	// Compare with the last snapshot and notify if changed
+	changes, err := History.Record(db, user.UserID, entries, today)
 	if err != nil {
-		fmt.Println("Error creating DM channel:", err)
-		return
+		logger.ErrorContext(ctx, "Error saving timetable snapshot", "err", err)
+	}
+	if len(changes) > 0 {
+		sendLessonNotification(user.UserID, user.Username, "Your timetable has changed!")
 	}
-	s.ChannelMessageSend(channel.ID, fmt.Sprintf("**%s**: %s", username, message))
+	return len(changes)
 }
 
-// Check for timetable changes for a user and notify if changed
-func checkTimetableChangesForUser(user Account, decPwd string, s *discordgo.Session) {
-	timetableFilledFile := getTimetableFilledFile(user.UserID)
+// Load all accounts from the store
+func loadAllAccounts() []Account {
+	accounts, err := db.Accounts()
+	if err != nil {
+		logger.Error("Error loading accounts", "err", err)
+	}
+	return accounts
+}
 
-	// Load previous timetable
-	prevData, _ := os.ReadFile(timetableFilledFile)
+var (
+	pool     *Pool.Pool
+	poolOnce sync.Once
+)
 
-	// TODO: Fetch new timetable for this user using user.Username and decrypted password
-	// For demonstration, we'll just copy prevData (replace this with real fetch logic!)
-	newData := prevData
+// fetchPool returns the pool the accounts are fetched with, sized by the
+// workers, per_server and jitter_seconds of the schedule config
+func fetchPool() *Pool.Pool {
+	poolOnce.Do(func() {
+		schedule := conf.Schedule
+		pool = Pool.New(schedule.Workers, schedule.PerServer, time.Duration(schedule.JitterSeconds)*time.Second)
+	})
+	return pool
+}
 
-	// Compare and notify if changed
-	if !bytes.Equal(newData, prevData) {
-		sendLessonNotification(s, user.UserID, user.Username, "Your timetable has changed!")
-		os.WriteFile(timetableFilledFile, newData, 0644)
+// untisServer is the host the accounts are fetched from
+func untisServer() string {
+	u, err := url.Parse(Untis.Url)
+	if err != nil {
+		return Untis.Url
 	}
+	return u.Host
 }
 
-// Load all accounts from accounts.json
-func loadAllAccounts() []Account {
-	var accounts []Account
-	if data, err := os.ReadFile(accountsFile); err == nil && len(data) > 0 {
-		_ = json.Unmarshal(data, &accounts)
+// Scheduled check for all users. The fetches run in the pool, an account
+// whose previous fetch is still running is skipped this time.
+func checkAllUsersTimetables() {
+	if keys == nil {
+		return
+	}
+	for _, user := range loadAllAccounts() {
+		submitFetch(user)
 	}
-	return accounts
 }
 
-// Scheduled check for all users
-func checkAllUsersTimetables(s *discordgo.Session) {
-	accounts := loadAllAccounts()
-	for _, user := range accounts {
-		decPwd, _ := decrypt(user.Password)
-		// You can use decPwd to fetch the timetable for this user
-		checkTimetableChangesForUser(user, decPwd, s)
-	}
+// submitFetch queues a fetch of the timetable of an account, false if one is
+// still queued or running
+func submitFetch(user Account) bool {
+	return fetchPool().Submit(Pool.Job{Key: user.UserID, Server: untisServer(), Run: func() {
+		creds, err := credentials(user, scheduledFetch)
+		if err != nil {
+			logger.Error("Error decrypting password", "account", user.UserID, "err", err)
+			return
+		}
+		checkTimetableChangesForUser(user, creds)
+	}})
 }
 
 var DiscordSession *discordgo.Session
 
-func Start() {
-	token := os.Getenv("DISCORD_BOT_TOKEN")
+// SetStore sets where accounts and preferences are kept, call it before Start
+func SetStore(st Store.Store) {
+	db = st
+}
+
+// Start connects the bot to Discord with the given config and starts the
+// scheduled fetches, which stop when ctx is done. Call Wait and Close to
+// shut down.
+func Start(ctx context.Context, cfg *Config.Config) {
+	rootCtx = ctx
+	conf = cfg
+	Notify.Register("dm", sendDM)
+
+	token := cfg.Discord.Token
 	if token == "" {
-		fmt.Println("DISCORD_BOT_TOKEN environment variable is not set.")
+		logger.Warn("discord.token (DISCORD_BOT_TOKEN) is not set, the bot is disabled")
 		return
 	}
 
 	dg, err := discordgo.New("Bot " + token)
 	if err != nil {
-		fmt.Println("error creating Discord session,", err)
+		logger.Error("Error creating Discord session", "err", err)
 		return
 	}
 	DiscordSession = dg // Save session for use elsewhere
 
 	dg.AddHandler(messageCreate)
+	dg.AddHandler(func(s *discordgo.Session, c *discordgo.Connect) { Status.RecordGateway(true) })
+	dg.AddHandler(func(s *discordgo.Session, r *discordgo.Resumed) { Status.RecordGateway(true) })
+	dg.AddHandler(func(s *discordgo.Session, d *discordgo.Disconnect) { Status.RecordGateway(false) })
+	Status.RecordGateway(false)
 	err = dg.Open()
 	if err != nil {
-		fmt.Println("error opening connection,", err)
+		logger.Error("Error connecting to Discord", "err", err)
+		Status.RecordError("discord", err)
 		return
 	}
 
-	// Schedule timetable checks every minute (or hour as needed)
+	// Schedule timetable checks every check_interval
 	go func() {
-		ticker := time.NewTicker(1 * time.Minute)
-		for range ticker.C {
-			checkAllUsersTimetables(dg)
+		for {
+			select {
+			case <-clock.After(cfg.Schedule.CheckInterval):
+				checkAllUsersTimetables()
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
-	fmt.Println("Bot is now running. Press CTRL+C to exit.")
-	// Wait for CTRL+C or other term signal to exit.
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
-	<-sc
+	logger.Info("Bot is now running")
+}
 
-	dg.Close()
+// Wait drops the fetches that did not start yet and waits until the running
+// ones are finished or ctx is done
+func Wait(ctx context.Context) error {
+	return fetchPool().Stop(ctx)
 }
 
-// Expose this for main.go to trigger notifications
-func NotifyAllUsers() {
+// Close closes the connection to Discord
+func Close() {
 	if DiscordSession != nil {
-		checkAllUsersTimetables(DiscordSession)
+		if err := DiscordSession.Close(); err != nil {
+			logger.Error("Error closing Discord connection", "err", err)
+		}
 	}
 }
 
@@ -261,20 +482,35 @@ func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}
 
-	// Handle "!addaccount" only in guilds (not in DMs)
-	if m.GuildID != "" && m.Content == "!addaccount" {
+	if m.Content == "!admin" || strings.HasPrefix(m.Content, "!admin ") {
+		Metrics.DiscordCommands.Inc("!admin")
+		handleAdmin(s, m)
+		return
+	}
+
+	// Handle "!addaccount" and "!addaccount secret" only in guilds (not in DMs)
+	if m.GuildID != "" && (m.Content == "!addaccount" || m.Content == "!addaccount secret") {
+		Metrics.DiscordCommands.Inc("!addaccount")
 		// Delete the command for privacy
 		_ = s.ChannelMessageDelete(m.ChannelID, m.ID)
+		if keys == nil {
+			s.ChannelMessageSend(m.ChannelID, "Adding accounts is disabled on this bot, no encryption key is configured.")
+			return
+		}
+		if isBlocked(m.GuildID, m.Author.ID) {
+			s.ChannelMessageSend(m.ChannelID, "You are not allowed to add accounts on this server.")
+			return
+		}
 		// Create DM channel
 		channel, err := s.UserChannelCreate(m.Author.ID)
 		if err != nil {
-			fmt.Println("Error creating DM channel:", err)
+			logger.Error("Error creating DM channel", "err", err)
 			return
 		}
-		s.ChannelMessageSend(channel.ID, "Let's add your account. Please provide your username:")
+		s.ChannelMessageSend(channel.ID, "Let's add your account. Please provide your username, or the link of the QR code WebUntis shows under Profile > Data access to add the account without your password:")
 
 		stateMutex.Lock()
-		userStates[m.Author.ID] = &UserState{Step: "awaiting_username"}
+		userStates[m.Author.ID] = &UserState{Step: "awaiting_username", GuildID: m.GuildID, Secret: m.Content == "!addaccount secret"}
 		stateMutex.Unlock()
 		return
 	}
@@ -285,27 +521,55 @@ func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		state, ok := userStates[m.Author.ID]
 		stateMutex.Unlock()
 		if !ok {
+			switch m.Content {
+			case "!ical", "!changes", "!pause", "!resume", "!audit":
+				Metrics.DiscordCommands.Inc(m.Content)
+			}
+			switch m.Content {
+			case "!ical":
+				sendFeedLink(s, m.ChannelID, m.Author.ID)
+			case "!changes":
+				sendRecentChanges(s, m.ChannelID, m.Author.ID)
+			case "!pause", "!resume":
+				setPaused(s, m.ChannelID, m.Author.ID, m.Content == "!pause")
+			case "!audit":
+				if isOperator(m.Author.ID) {
+					Audit.Log(Audit.AdminCommand, m.Author.ID, "", m.Content)
+					sendAuditLog(s, m.Author.ID)
+				}
+			}
 			return // Not in the process
 		}
 
 		switch state.Step {
 		case "awaiting_username":
-			// Store the username and prompt for password
+			if strings.HasPrefix(strings.TrimSpace(m.Content), "untis://") {
+				addAccountFromQRCode(s, m, state.GuildID)
+				return
+			}
+			// Store the username and prompt for the password or the key
 			stateMutex.Lock()
 			state.Username = m.Content
 			state.Step = "awaiting_password"
+			if state.Secret {
+				state.Step = "awaiting_secret"
+			}
 			userStates[m.Author.ID] = state
 			stateMutex.Unlock()
-			s.ChannelMessageSend(m.ChannelID, "Now, please provide your password:")
+			if state.Secret {
+				s.ChannelMessageSend(m.ChannelID, "Now, please provide the key from your WebUntis QR code:")
+			} else {
+				s.ChannelMessageSend(m.ChannelID, "Now, please provide your password:")
+			}
+		case "awaiting_secret":
+			addAccountFromSecret(s, m, state)
 		case "awaiting_password":
-			username := state.Username
-			password := m.Content
-			// Save to JSON
-			if err := saveAccount(m.Author.ID, username, password); err != nil {
+			if err := saveAccount(m.Author.ID, state.GuildID, state.Username, m.Content, ""); err != nil {
 				s.ChannelMessageSend(m.ChannelID, "There was an error saving your account. Please try again later.")
-				fmt.Println("Error saving account:", err)
+				logger.Error("Error saving account", "err", err)
 			} else {
 				s.ChannelMessageSend(m.ChannelID, "Your account has been saved!")
+				sendFeedLink(s, m.ChannelID, m.Author.ID)
 			}
 			// Cleanup state
 			stateMutex.Lock()
@@ -314,3 +578,126 @@ func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		}
 	}
 }
+
+// addAccountFromSecret saves the account of state with the key of its QR
+// code in m, after logging in with it worked
+func addAccountFromSecret(s *discordgo.Session, m *discordgo.MessageCreate, state *UserState) {
+	defer func() {
+		stateMutex.Lock()
+		delete(userStates, m.Author.ID)
+		stateMutex.Unlock()
+	}()
+	secret := strings.TrimSpace(m.Content)
+	if _, err := Untis.TOTP(secret, clock.Now()); err != nil {
+		s.ChannelMessageSend(m.ChannelID, "That is not the key of a WebUntis QR code ("+err.Error()+"), use !addaccount secret to try again.")
+		return
+	}
+	session, err := Untis.AuthSecret(rootCtx, state.Username, secret)
+	if err != nil {
+		logger.Error("Error logging in with app secret", "err", err)
+		s.ChannelMessageSend(m.ChannelID, "Logging in with the key did not work, please create a new QR code and try again with !addaccount secret.")
+		return
+	}
+	Untis.Logout(rootCtx, session)
+	if err := saveAccount(m.Author.ID, state.GuildID, state.Username, "", secret); err != nil {
+		s.ChannelMessageSend(m.ChannelID, "There was an error saving your account. Please try again later.")
+		logger.Error("Error saving account", "err", err)
+		return
+	}
+	s.ChannelMessageSend(m.ChannelID, "Your account has been saved, your password is not stored!")
+	sendFeedLink(s, m.ChannelID, m.Author.ID)
+}
+
+// addAccountFromQRCode saves the account from the QR code link in m, only
+// the app secret is kept and no password
+func addAccountFromQRCode(s *discordgo.Session, m *discordgo.MessageCreate, guildID string) {
+	defer func() {
+		stateMutex.Lock()
+		delete(userStates, m.Author.ID)
+		stateMutex.Unlock()
+	}()
+	code, err := Untis.ParseQRCode(m.Content)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, "That is not a valid WebUntis QR code link ("+err.Error()+"), use !addaccount to try again.")
+		return
+	}
+	server, school := Untis.School()
+	if !strings.EqualFold(code.School, school) || (code.Server != "" && !strings.EqualFold(code.Server, server)) {
+		s.ChannelMessageSend(m.ChannelID, "This bot only works for the school "+school+", the QR code is for "+code.School+".")
+		return
+	}
+	session, err := Untis.AuthSecret(rootCtx, code.User, code.Secret)
+	if err != nil {
+		logger.Error("Error logging in with QR code", "err", err)
+		s.ChannelMessageSend(m.ChannelID, "Logging in with the QR code did not work, please create a new one and try again with !addaccount.")
+		return
+	}
+	Untis.Logout(rootCtx, session)
+	if err := saveAccount(m.Author.ID, guildID, code.User, "", code.Secret); err != nil {
+		s.ChannelMessageSend(m.ChannelID, "There was an error saving your account. Please try again later.")
+		logger.Error("Error saving account", "err", err)
+		return
+	}
+	s.ChannelMessageSend(m.ChannelID, "Your account has been saved, your password is not stored!")
+	sendFeedLink(s, m.ChannelID, m.Author.ID)
+}
+
+// Send the calendar feed link of a user into the given (DM) channel
+func sendFeedLink(s *discordgo.Session, channelID, userID string) {
+	acc, ok := accountByUserID(userID)
+	if !ok {
+		s.ChannelMessageSend(channelID, "You have no account yet, use !addaccount in a server first.")
+		return
+	}
+	link := feedURL(acc)
+	if link == "" {
+		s.ChannelMessageSend(channelID, "Calendar feeds are not enabled on this bot.")
+		return
+	}
+	s.ChannelMessageSend(channelID, "Subscribe to your timetable in your calendar app with this link (keep it private): "+link)
+}
+
+// Send the timetable changes of the last week into the given (DM) channel
+func sendRecentChanges(s *discordgo.Session, channelID, userID string) {
+	now := clock.Now()
+	changes, err := History.Changes(db, userID, now.AddDate(0, 0, -7), now)
+	if err != nil {
+		logger.Error("Error reading changes", "err", err)
+		s.ChannelMessageSend(channelID, "Your changes could not be loaded, please try again later.")
+		return
+	}
+	if len(changes) == 0 {
+		s.ChannelMessageSend(channelID, "No changes to your timetable in the last 7 days.")
+		return
+	}
+	var b strings.Builder
+	b.WriteString("Changes in the last 7 days:\n")
+	for _, change := range changes {
+		line := change.String() + "\n"
+		if b.Len()+len(line) > 1900 { // Discord messages are limited to 2000 characters
+			b.WriteString("...")
+			break
+		}
+		b.WriteString(line)
+	}
+	s.ChannelMessageSend(channelID, b.String())
+}
+
+// Turn the DMs about timetable changes of a user off or on again
+func setPaused(s *discordgo.Session, channelID, userID string, paused bool) {
+	prefs, err := db.Preferences(userID)
+	if err == nil {
+		prefs.Paused = paused
+		err = db.SavePreferences(userID, prefs)
+	}
+	if err != nil {
+		logger.Error("Error saving preferences", "err", err)
+		s.ChannelMessageSend(channelID, "Your settings could not be saved, please try again later.")
+		return
+	}
+	if paused {
+		s.ChannelMessageSend(channelID, "You will not get messages about timetable changes anymore, write !resume to get them again.")
+	} else {
+		s.ChannelMessageSend(channelID, "You will get messages about timetable changes again.")
+	}
+}
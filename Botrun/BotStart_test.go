@@ -0,0 +1,153 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	Audit "untislogger/Audit"
+	Clock "untislogger/Clock"
+	Secrets "untislogger/Secrets"
+	Store "untislogger/Store"
+)
+
+// setup gives the bot an empty store and a key for the test
+func setup(t *testing.T) {
+	t.Helper()
+	st, err := Store.Open("json", "", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := Secrets.ParseKeys("test:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDB, oldKeys := db, keys
+	SetStore(st)
+	SetKeys(k)
+	t.Cleanup(func() { db, keys = oldDB, oldKeys })
+}
+
+func account(t *testing.T, userID string) Account {
+	t.Helper()
+	acc, found, err := Store.FindAccount(db, userID)
+	if err != nil || !found {
+		t.Fatalf("account %s not found: %v", userID, err)
+	}
+	return acc
+}
+
+func TestSaveAccount(t *testing.T) {
+	setup(t)
+	if err := saveAccount("42", "guild", "anna", "hunter22", ""); err != nil {
+		t.Fatal(err)
+	}
+	acc := account(t, "42")
+	if acc.Username != "anna" || acc.GuildID != "guild" || acc.Secret != "" {
+		t.Errorf("saved %+v", acc)
+	}
+	if strings.Contains(acc.Password, "hunter22") {
+		t.Error("the password is saved in plain text")
+	}
+	if acc.FeedToken == "" {
+		t.Error("no calendar feed token")
+	}
+	creds, err := credentials(acc, "test")
+	if err != nil || creds.User != "anna" || creds.Password != "hunter22" {
+		t.Errorf("credentials() = %+v, %v", creds, err)
+	}
+
+	// replacing the account keeps the feed token, a secret replaces the password
+	if err := saveAccount("42", "guild", "anna", "", "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatal(err)
+	}
+	replaced := account(t, "42")
+	if replaced.FeedToken != acc.FeedToken {
+		t.Errorf("feed token changed from %q to %q", acc.FeedToken, replaced.FeedToken)
+	}
+	if replaced.Password != "" || replaced.Secret == "" {
+		t.Errorf("replaced account has password %q and secret %q, want only the secret", replaced.Password, replaced.Secret)
+	}
+	creds, err = credentials(replaced, "test")
+	if err != nil || creds.Secret != "JBSWY3DPEHPK3PXP" || creds.Password != "" {
+		t.Errorf("credentials() = %+v, %v", creds, err)
+	}
+
+	// a second user gets an own account and feed token
+	if err := saveAccount("43", "", "ben", "password", ""); err != nil {
+		t.Fatal(err)
+	}
+	if other := account(t, "43"); other.FeedToken == acc.FeedToken {
+		t.Error("two accounts share a feed token")
+	}
+	accounts, _ := db.Accounts()
+	if len(accounts) != 2 {
+		t.Errorf("%d accounts saved, want 2", len(accounts))
+	}
+}
+
+func TestSaveAccountBoundToUser(t *testing.T) {
+	setup(t)
+	if err := saveAccount("42", "", "anna", "hunter22", ""); err != nil {
+		t.Fatal(err)
+	}
+	// a password copied to another account can not be decrypted there
+	acc := account(t, "42")
+	acc.UserID = "43"
+	if _, err := credentials(acc, "test"); err == nil {
+		t.Error("credentials() of a copied password did not fail")
+	}
+}
+
+func TestSaveAccountWithoutKeys(t *testing.T) {
+	setup(t)
+	keys = nil
+	if err := saveAccount("42", "", "anna", "hunter22", ""); !errors.Is(err, Secrets.ErrNoKeys) {
+		t.Errorf("saveAccount() without keys = %v, want ErrNoKeys", err)
+	}
+	if _, found, _ := Store.FindAccount(db, "42"); found {
+		t.Error("account saved without keys")
+	}
+}
+
+func TestAuditScheduledFetches(t *testing.T) {
+	setup(t)
+	Audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"), 0)
+	defer Audit.Open("", 0)
+	fake := Clock.NewFake(time.Date(2025, 9, 5, 0, 0, 0, 0, time.Local))
+	SetClock(fake)
+	defer SetClock(Clock.Real)
+	if err := saveAccount("42", "guild", "anna", "hunter22", ""); err != nil {
+		t.Fatal(err)
+	}
+	acc := account(t, "42")
+
+	// every minute for two days, and one fetch from the web
+	for i := 0; i < 2*24*60; i++ {
+		if _, err := credentials(acc, scheduledFetch); err != nil {
+			t.Fatal(err)
+		}
+		fake.Advance(time.Minute)
+	}
+	if _, err := credentials(acc, "web"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := Audit.Recent(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var details []string
+	for _, entry := range entries {
+		if entry.Action == Audit.CredentialsUsed {
+			details = append(details, entry.Detail)
+		}
+	}
+	want := []string{"web", "scheduled fetch, the first today", "scheduled fetch, the first today"}
+	if !slices.Equal(details, want) {
+		t.Errorf("audited decryptions %q, want %q", details, want)
+	}
+}
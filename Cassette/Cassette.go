@@ -0,0 +1,315 @@
+package cassette
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	Logging "untislogger/Logging"
+)
+
+// Interaction is one request to Untis and its response, a cassette file has
+// one per line. Passwords, one time passwords, user names and session IDs are
+// replaced with [REDACTED].
+type Interaction struct {
+	Time     time.Time       `json:"time"`
+	Account  string          `json:"account,omitempty"` // main or the Discord user ID
+	Session  int             `json:"session"`           // numbers the Untis sessions, so interleaved fetches can be told apart
+	Method   string          `json:"method"`            // the JSON-RPC method, or the last part of the path for other requests
+	URL      string          `json:"url"`
+	Request  json.RawMessage `json:"request,omitempty"`
+	Status   int             `json:"status"`
+	Cookies  []string        `json:"cookies,omitempty"`  // names of the cookies set by the response, the values are not kept
+	Response json.RawMessage `json:"response,omitempty"` // the body if it is JSON
+	Body     string          `json:"body,omitempty"`     // the body if it is not JSON
+}
+
+// Keys whose string values are removed from requests and responses
+var secretKeys = map[string]bool{"password": true, "user": true, "otp": true, "sessionid": true, "secret": true, "token": true}
+
+var logger = Logging.For("cassette")
+
+// Recorder is an http.RoundTripper that sends requests on with next and
+// appends them and their responses to a cassette file
+type Recorder struct {
+	next http.RoundTripper
+
+	mutex    sync.Mutex
+	file     *os.File
+	sessions map[string]int // JSESSIONID -> session number, until the logout
+	last     int            // the number of the last session
+}
+
+// Record appends the Untis traffic to the cassette file at path, sent on
+// with next (http.DefaultTransport if nil)
+func Record(file string, next http.RoundTripper) (*Recorder, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	r := &Recorder{next: next, sessions: make(map[string]int)}
+	// sessions of an earlier run keep their numbers
+	previous, err := Load(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, in := range previous {
+		r.last = max(r.last, in.Session)
+	}
+	if r.file, err = os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close closes the cassette file
+func (r *Recorder) Close() error {
+	return r.file.Close()
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		if reqBody, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+	taken := time.Now()
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	in := Interaction{
+		Time:    taken,
+		Method:  method(req, reqBody),
+		URL:     Logging.Redact(req.URL.Redacted()),
+		Request: scrub(reqBody),
+		Status:  resp.StatusCode,
+	}
+	in.Account, _ = Logging.Get(req.Context(), "account")
+	if json.Valid(body) {
+		in.Response = scrub(body)
+	} else {
+		in.Body = Logging.Redact(string(body))
+	}
+	for _, c := range resp.Cookies() {
+		in.Cookies = append(in.Cookies, c.Name)
+	}
+	r.write(req, resp, in)
+	return resp, nil
+}
+
+// write numbers the session of the interaction and appends it to the file,
+// errors are only logged so recording never stops a fetch
+func (r *Recorder) write(req *http.Request, resp *http.Response, in Interaction) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if c, err := req.Cookie("JSESSIONID"); err == nil {
+		in.Session = r.sessions[c.Value]
+		if in.Method == "logout" {
+			delete(r.sessions, c.Value)
+		}
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == "JSESSIONID" && r.sessions[c.Value] == 0 {
+			r.last++
+			r.sessions[c.Value] = r.last
+			in.Session = r.last
+		}
+	}
+	data, err := json.Marshal(in)
+	if err == nil {
+		_, err = r.file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		logger.Error("Error writing cassette", "err", err)
+	}
+}
+
+// method returns the JSON-RPC method of a request, or the last part of its
+// path for the other requests
+func method(req *http.Request, body []byte) string {
+	var rpc struct {
+		Method string `json:"method"`
+	}
+	if json.Unmarshal(body, &rpc) == nil && rpc.Method != "" {
+		return rpc.Method
+	}
+	return path.Base(req.URL.Path)
+}
+
+// scrub removes the secrets from a JSON body, a body that is not JSON is
+// dropped
+func scrub(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil
+	}
+	out, err := json.Marshal(scrubValue("", v))
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func scrubValue(key string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = scrubValue(k, item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = scrubValue(key, item)
+		}
+		return v
+	}
+	if v != nil && secretKeys[strings.ToLower(key)] {
+		return Logging.Redacted
+	}
+	if s, ok := v.(string); ok {
+		return Logging.Redact(s)
+	}
+	return v
+}
+
+// Load reads a cassette file
+func Load(file string) ([]Interaction, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []Interaction
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20) // a timetable of a whole year is a long line
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var in Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &in); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", file, line, err)
+		}
+		out = append(out, in)
+	}
+	return out, scanner.Err()
+}
+
+// Fetch is one Untis session of a cassette, from the login to the logout
+type Fetch struct {
+	Account      string
+	Time         time.Time // when it was logged in
+	Interactions []Interaction
+}
+
+// Secret reports whether the session logged in with an app secret instead of
+// a password
+func (f Fetch) Secret() bool {
+	return len(f.Interactions) > 0 && f.Interactions[0].Method == "getUserData2017"
+}
+
+// Fetches splits a cassette into its sessions in the order they were logged
+// in. Failed logins, which have no session, are left out.
+func Fetches(interactions []Interaction) []Fetch {
+	var out []Fetch
+	index := make(map[int]int) // session -> index in out
+	for _, in := range interactions {
+		if in.Session == 0 {
+			continue
+		}
+		i, ok := index[in.Session]
+		if !ok {
+			i = len(out)
+			index[in.Session] = i
+			out = append(out, Fetch{Account: in.Account, Time: in.Time})
+		}
+		if out[i].Account == "" {
+			out[i].Account = in.Account
+		}
+		out[i].Interactions = append(out[i].Interactions, in)
+	}
+	return out
+}
+
+// Replayer is an http.RoundTripper answering from the interactions of a
+// cassette instead of sending the requests. Every interaction is used once,
+// in order for each method.
+type Replayer struct {
+	mutex        sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+// Replay answers requests with the interactions
+func Replay(interactions []Interaction) *Replayer {
+	return &Replayer{interactions: interactions, used: make([]bool, len(interactions))}
+}
+
+// ErrNoInteraction is returned for a request the cassette has no answer for
+var ErrNoInteraction = errors.New("cassette has no answer left")
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	m := method(req, body)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, in := range r.interactions {
+		if r.used[i] || in.Method != m {
+			continue
+		}
+		r.used[i] = true
+		resp := &http.Response{
+			Status:     fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+			StatusCode: in.Status,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Request:    req,
+		}
+		data := []byte(in.Body)
+		if in.Response != nil {
+			data = in.Response
+			resp.Header.Set("Content-Type", "application/json")
+		}
+		for _, name := range in.Cookies {
+			resp.Header.Add("Set-Cookie", (&http.Cookie{Name: name, Value: fmt.Sprintf("replayed-%d", in.Session), Path: "/"}).String())
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		resp.ContentLength = int64(len(data))
+		return resp, nil
+	}
+	return nil, fmt.Errorf("%w for %s", ErrNoInteraction, m)
+}
@@ -0,0 +1,181 @@
+package cassette
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	Untis "untislogger/Bot"
+	Mock "untislogger/Mock"
+	Store "untislogger/Store"
+)
+
+// useClient points the Untis client at url with the transport for the test
+func useClient(t *testing.T, url string, transport http.RoundTripper) {
+	t.Helper()
+	oldURL, oldClient := Untis.Url, Untis.Client
+	Untis.Url = url + "/WebUntis/jsonrpc.do?school=Demo"
+	Untis.Client = &http.Client{Transport: transport}
+	t.Cleanup(func() { Untis.Url, Untis.Client = oldURL, oldClient })
+}
+
+func openStore(t *testing.T) Store.Store {
+	t.Helper()
+	st, err := Store.Open("json", "", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	start := time.Now()
+	var offset atomic.Int64
+	fixtures := Mock.Default()
+	every := []int{1, 2, 3, 4, 5, 6, 7}
+	fixtures.Holidays = nil
+	fixtures.Lessons = []Mock.Lesson{{ID: 1, Weekdays: every, StartTime: 745, EndTime: 830, Kl: []int{1}, Su: []int{1}, Ro: []int{1}}}
+	fixtures.Changes = []Mock.Change{{After: Mock.Duration(time.Minute), Lesson: 1, Date: "today", Code: "cancelled"}}
+	server := httptest.NewServer(Mock.New(fixtures, func() time.Time { return start.Add(time.Duration(offset.Load())) }))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "cassette.jsonl")
+	recorder, err := Record(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useClient(t, server.URL, recorder)
+
+	// two fetches, the lesson is cancelled in between
+	st := openStore(t)
+	creds := Untis.Credentials{User: "demo", Password: "demo-password"}
+	var recorded [][]Untis.NamedTimetableEntry
+	for _, ahead := range []time.Duration{0, 2 * time.Minute} {
+		offset.Store(int64(ahead))
+		if err := Untis.Main(context.Background(), st, Store.MainAccount, creds); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := st.Timetable(Store.MainAccount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorded = append(recorded, entries)
+	}
+	if reflect.DeepEqual(recorded[0], recorded[1]) {
+		t.Fatal("the scripted change did not show up while recording")
+	}
+	recorder.Close()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"demo-password", `"demo"`, "JSESSIONID="} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("the cassette contains %s", secret)
+		}
+	}
+
+	interactions, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := Fetches(interactions)
+	if len(fetches) != 2 {
+		t.Fatalf("%d fetches in the cassette, want 2", len(fetches))
+	}
+	for i, f := range fetches {
+		if f.Account != Store.MainAccount || f.Secret() {
+			t.Errorf("fetch %d is of account %q, secret %v", i, f.Account, f.Secret())
+		}
+		var methods []string
+		for _, in := range f.Interactions {
+			methods = append(methods, in.Method)
+		}
+		if methods[0] != "authenticate" || methods[len(methods)-1] != "logout" {
+			t.Errorf("fetch %d made the requests %v", i, methods)
+		}
+	}
+
+	// the replay gives the same timetables without the server
+	server.Close()
+	replayed := openStore(t)
+	for i, f := range fetches {
+		useClient(t, "http://untis.invalid", Replay(f.Interactions))
+		if err := Untis.Main(context.Background(), replayed, Store.MainAccount, Untis.Credentials{User: "x", Password: "y"}); err != nil {
+			t.Fatalf("replaying fetch %d: %v", i, err)
+		}
+		entries, err := replayed.Timetable(Store.MainAccount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(entries, recorded[i]) {
+			t.Errorf("fetch %d replayed %+v, recorded %+v", i, entries, recorded[i])
+		}
+	}
+}
+
+func TestRecordSessionsContinue(t *testing.T) {
+	server := httptest.NewServer(Mock.New(Mock.Default(), nil))
+	defer server.Close()
+	file := filepath.Join(t.TempDir(), "cassette.jsonl")
+	creds := Untis.Credentials{User: "demo", Password: "demo-password"}
+	// a restart appends to the cassette, the sessions keep apart
+	for run := 0; run < 2; run++ {
+		recorder, err := Record(file, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		useClient(t, server.URL, recorder)
+		if err := Untis.Main(context.Background(), openStore(t), Store.MainAccount, creds); err != nil {
+			t.Fatal(err)
+		}
+		recorder.Close()
+	}
+	interactions, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(Fetches(interactions)); n != 2 {
+		t.Errorf("%d fetches after two runs, want 2", n)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`{"method":"authenticate","params":{"user":"anna","password":"p\"w d","client":"x"}}`,
+			`{"method":"authenticate","params":{"client":"x","password":"[REDACTED]","user":"[REDACTED]"}}`},
+		{`{"params":[{"auth":{"clientTime":1757000000000,"otp":123456,"user":"anna"}}]}`,
+			`{"params":[{"auth":{"clientTime":1757000000000,"otp":"[REDACTED]","user":"[REDACTED]"}}]}`},
+		{`{"result":{"sessionId":"ABC123","personId":7}}`, `{"result":{"personId":7,"sessionId":"[REDACTED]"}}`},
+		{`{"result":{"user":{"personId":7}}}`, `{"result":{"user":{"personId":7}}}`},
+		{`not json`, ``},
+	}
+	for _, tt := range tests {
+		if got := string(scrub([]byte(tt.in))); got != tt.want {
+			t.Errorf("scrub(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestReplayRunsOut(t *testing.T) {
+	r := Replay([]Interaction{{Method: "getRooms", Status: 200, Response: []byte(`{"result":[]}`)}})
+	req := func() (*http.Response, error) {
+		return r.RoundTrip(httptest.NewRequest("POST", "http://untis.invalid/", strings.NewReader(`{"method":"getRooms"}`)))
+	}
+	if resp, err := req(); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("first request = %v, %v", resp, err)
+	}
+	if _, err := req(); err == nil {
+		t.Error("the second request was answered from a cassette with one")
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	Untis "untislogger/Bot"
+	BotStart "untislogger/Botrun"
+	Cassette "untislogger/Cassette"
+	Clock "untislogger/Clock"
+	History "untislogger/History"
+	Mock "untislogger/Mock"
+	Notify "untislogger/Notify"
+	Store "untislogger/Store"
+)
+
+const usageText = `Usage: untislogger [-config file] [-dry-run] <command> [arguments]
+
+Commands:
+  serve                                   run the bot, the webhook and the web server (default)
+  fetch [-account id] [-from date] [-to date] [-json] [-save]
+                                          fetch a timetable from Untis and print it
+  show today [-account id] [-json]        print the stored timetable of today
+  show snapshots [-account id]            list the stored snapshots of an account
+  diff [-account id] <snapshot> <snapshot>
+                                          print the changes between two snapshots
+  accounts list                           list the main account and the added accounts
+  accounts remove <id>                    remove an account added with !addaccount
+  masterdata dump [kind...]               print the stored rooms, classes, subjects or teachers
+  notify test [webhook | dm <user id>]    send a test notification right away
+  rotate-keys                             re-encrypt the stored passwords with the first key
+  mock-untis [-addr host:port] [-fixtures dir]
+                                          run a fake WebUntis server with the demo school or the fixtures in dir
+  replay [-account id] [-data dir] <cassette>
+                                          fetch, diff and notify the main account from a recorded cassette
+
+Dates are like 2025-09-01, snapshots are the time they were taken like
+2025-09-01T08:00:00+02:00 or 2025-09-01 08:00, or latest. The account id is
+main for the account of the config or the Discord user id.
+`
+
+func usage() {
+	fmt.Fprint(os.Stderr, usageText)
+	flag.PrintDefaults()
+}
+
+// runCommand runs one of the one-off commands, they stop when ctx is done
+func runCommand(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "fetch":
+		return fetchCommand(ctx, args[1:])
+	case "show":
+		return showCommand(args[1:])
+	case "diff":
+		return diffCommand(args[1:])
+	case "accounts":
+		return accountsCommand(args[1:])
+	case "masterdata":
+		return masterdataCommand(args[1:])
+	case "notify":
+		return notifyCommand(ctx, args[1:])
+	case "mock-untis":
+		return mockCommand(ctx, args[1:])
+	case "replay":
+		return replayCommand(ctx, args[1:])
+	}
+	usage()
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// newFlags returns the flags of a command with the -account flag every
+// command that works on one account has
+func newFlags(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	account := flags.String("account", Store.MainAccount, "main or the Discord user id of the account")
+	return flags, account
+}
+
+// accountCredentials returns the credentials of the main account or of an
+// account added with !addaccount
+func accountCredentials(account string) (Untis.Credentials, error) {
+	if account == Store.MainAccount {
+		if conf.Untis.User == "" {
+			return Untis.Credentials{}, errors.New("untis.user is not set")
+		}
+		return Untis.MainCredentials(conf.Untis), nil
+	}
+	_, creds, ok := BotStart.Credentials(account, "cli")
+	if !ok {
+		return Untis.Credentials{}, fmt.Errorf("no account %s, or its password can not be decrypted", account)
+	}
+	return creds, nil
+}
+
+func fetchCommand(ctx context.Context, args []string) error {
+	flags, account := newFlags("fetch")
+	today := clock.Now().Format("2006-01-02")
+	from := flags.String("from", today, "first day")
+	to := flags.String("to", "", "last day, default the first day")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	save := flags.Bool("save", false, "save the timetable and record a snapshot like the bot does")
+	flags.Parse(args)
+	if *to == "" {
+		*to = *from
+	}
+	start, err := time.ParseInLocation("2006-01-02", *from, time.Local)
+	if err != nil {
+		return fmt.Errorf("-from: %q is not a date like %s", *from, today)
+	}
+	end, err := time.ParseInLocation("2006-01-02", *to, time.Local)
+	if err != nil {
+		return fmt.Errorf("-to: %q is not a date like %s", *to, today)
+	}
+	if end.Before(start) {
+		return errors.New("-to is before -from")
+	}
+
+	creds, err := accountCredentials(*account)
+	if err != nil {
+		return err
+	}
+	entries, err := Untis.FetchNamedTimetable(ctx, db, creds, start, end)
+	if err != nil {
+		return err
+	}
+	if *save {
+		if err := db.SaveTimetable(*account, entries); err != nil {
+			return err
+		}
+		changes, err := History.Record(db, *account, entries, clock.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Saved, %d changes since the last snapshot\n", len(changes))
+	}
+	return printTimetable(entries, *asJSON)
+}
+
+func showCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("show what? today or snapshots")
+	}
+	flags, account := newFlags("show " + args[0])
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	flags.Parse(args[1:])
+	switch args[0] {
+	case "today":
+		entries, err := db.Timetable(*account)
+		if err != nil {
+			return fmt.Errorf("no timetable stored for %s: %w", *account, err)
+		}
+		return printTimetable(entries, *asJSON)
+	case "snapshots":
+		infos, err := History.List(db, *account)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TAKEN\tLESSONS\tCHANGES")
+		for _, info := range infos {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", info.Taken.Format(time.RFC3339), info.Lessons, info.Changes)
+		}
+		return w.Flush()
+	}
+	return fmt.Errorf("unknown show %q, use today or snapshots", args[0])
+}
+
+func diffCommand(args []string) error {
+	flags, account := newFlags("diff")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return errors.New("diff needs two snapshots")
+	}
+	var snaps [2]Store.Snapshot
+	for i, arg := range flags.Args() {
+		snap, err := findSnapshot(*account, arg)
+		if err != nil {
+			return err
+		}
+		snaps[i] = snap
+	}
+	changes := Untis.Diff(snaps[0].Entries, snaps[1].Entries, snaps[1].Taken)
+	if len(changes) == 0 {
+		fmt.Println("No changes")
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	return nil
+}
+
+// findSnapshot returns the snapshot of account that was current at the time
+// in arg, or the newest one for latest
+func findSnapshot(account, arg string) (Store.Snapshot, error) {
+	at := clock.Now()
+	if arg != "latest" {
+		var err error
+		at, err = time.Parse(time.RFC3339, arg)
+		if err != nil {
+			at, err = time.ParseInLocation("2006-01-02 15:04", arg, time.Local)
+		}
+		if err != nil {
+			return Store.Snapshot{}, fmt.Errorf("%q is not a time like 2025-09-01T08:00:00+02:00 or 2025-09-01 08:00", arg)
+		}
+	}
+	snap, found, err := History.At(db, account, at)
+	if err != nil {
+		return Store.Snapshot{}, err
+	}
+	if !found {
+		return Store.Snapshot{}, fmt.Errorf("%s has no snapshot at %s", account, arg)
+	}
+	return snap, nil
+}
+
+func accountsCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("accounts list or accounts remove <id>")
+	}
+	switch args[0] {
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSERNAME\tLOGIN\tSERVER\tDMS")
+		if conf.Untis.User != "" {
+			login := "password"
+			if conf.Untis.Secret != "" {
+				login = "app secret"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t\t\n", Store.MainAccount, conf.Untis.User, login)
+		}
+		accounts, err := db.Accounts()
+		if err != nil {
+			return err
+		}
+		for _, acc := range accounts {
+			login := "password"
+			if acc.Secret != "" {
+				login = "app secret"
+			}
+			dms := "on"
+			if prefs, err := db.Preferences(acc.UserID); err == nil && prefs.Paused {
+				dms = "paused"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", acc.UserID, acc.Username, login, acc.GuildID, dms)
+		}
+		return w.Flush()
+	case "remove":
+		if len(args) != 2 {
+			return errors.New("accounts remove needs the id of the account")
+		}
+		if args[1] == Store.MainAccount {
+			return errors.New("the main account is set in the config")
+		}
+		if _, found, err := Store.FindAccount(db, args[1]); err != nil || !found {
+			return fmt.Errorf("no account %s", args[1])
+		}
+		if err := BotStart.RemoveAccount(args[1], "cli"); err != nil {
+			return err
+		}
+		fmt.Println("Removed", args[1])
+		return nil
+	}
+	return fmt.Errorf("unknown accounts %q, use list or remove", args[0])
+}
+
+func masterdataCommand(args []string) error {
+	if len(args) == 0 || args[0] != "dump" {
+		return errors.New("masterdata dump [rooms|classes|subjects|teachers...]")
+	}
+	kinds := args[1:]
+	if len(kinds) == 0 {
+		kinds = []string{"rooms", "classes", "subjects", "teachers"}
+	}
+	dump := make(map[string]json.RawMessage)
+	for _, kind := range kinds {
+		switch kind {
+		case "rooms", "classes", "subjects", "teachers":
+		default:
+			return fmt.Errorf("unknown master data %q", kind)
+		}
+		data, err := db.MasterData(kind)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "No %s stored yet\n", kind)
+			continue
+		}
+		dump[kind] = data
+	}
+	return printJSON(dump)
+}
+
+func notifyCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "test" {
+		return errors.New("notify test [webhook | dm <user id>]")
+	}
+	message := "Test notification from untislogger, sent " + clock.Now().Format("02.01. 15:04")
+	target := "webhook"
+	if len(args) > 1 {
+		target = args[1]
+	}
+	switch {
+	case target == "webhook" && Notify.Print("webhook", "", message),
+		target == "dm" && len(args) == 3 && Notify.Print("dm", args[2], message):
+		return nil
+	case target == "webhook":
+		if discordWebhookURL == "" {
+			return errors.New("notifiers.webhook_url (DISCORD_WEBHOOK_URL) is not set")
+		}
+		if err := deliverWebhook(ctx, "", message); err != nil {
+			return err
+		}
+	case target == "dm" && len(args) == 3:
+		if err := BotStart.SendDM(ctx, conf.Discord.Token, args[2], message); err != nil {
+			return err
+		}
+	default:
+		return errors.New("notify test [webhook | dm <user id>]")
+	}
+	fmt.Println("Sent")
+	return nil
+}
+
+func mockCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("mock-untis", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:8081", "address to listen on")
+	dir := flags.String("fixtures", "", "directory with the fixture files, missing files are taken from the demo school")
+	flags.Parse(args)
+	fixtures := Mock.Default()
+	if *dir != "" {
+		var err error
+		if fixtures, err = Mock.Load(*dir); err != nil {
+			return err
+		}
+	}
+	server := &http.Server{Addr: *addr, Handler: Mock.New(fixtures, nil)}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	fmt.Printf("Fake WebUntis server on http://%s, set untis.server (UNTIS_SERVER) to that address\n", *addr)
+	for _, user := range fixtures.Users {
+		if user.Password != "" {
+			fmt.Printf("  user %s, password %s\n", user.Name, user.Password)
+		}
+		if user.Secret != "" {
+			fmt.Printf("  user %s, app secret %s\n", user.Name, user.Secret)
+		}
+	}
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// replaySecret logs in the replayed sessions of accounts with an app
+// secret, the cassette answers whatever one time password is sent
+const replaySecret = "AAAAAAAAAAAAAAAA"
+
+func replayCommand(ctx context.Context, args []string) error {
+	flags, account := newFlags("replay")
+	dataDir := flags.String("data", "", "directory the replayed timetables and snapshots are kept in, default a temporary one")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("replay [-account id] [-data dir] <cassette>")
+	}
+	interactions, err := Cassette.Load(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var fetches []Cassette.Fetch
+	for _, f := range Cassette.Fetches(interactions) {
+		if f.Account == *account {
+			fetches = append(fetches, f)
+		}
+	}
+	if len(fetches) == 0 {
+		return fmt.Errorf("the cassette has no fetches of account %s", *account)
+	}
+
+	// the replay never touches the real timetables, history and outbox
+	dir := *dataDir
+	if dir == "" {
+		if dir, err = os.MkdirTemp("", "untislogger-replay-"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+	}
+	st, err := Store.Open("json", "", dir)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	db = st
+	BotStart.SetStore(st)
+	// the notifications are printed like with -dry-run
+	if !conf.Notifiers.DryRun {
+		conf.Notifiers.DryRun = true
+		Notify.DryRun(os.Stdout)
+	}
+
+	fake := Clock.NewFake(fetches[0].Time)
+	useClock(fake)
+	for _, f := range fetches {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// the lesson times since the last fetch post the next lesson of the
+		// main account like the bot does, the other accounts only get DMs
+		if *account == Store.MainAccount {
+			replayLessonTimes(fake, f.Time)
+		}
+		taken := f.Time
+		fake.Set(taken)
+		Untis.Client = &http.Client{Transport: Cassette.Replay(f.Interactions)}
+		creds := Untis.Credentials{User: "replay", Password: "replay"}
+		if f.Secret() {
+			creds = Untis.Credentials{User: "replay", Secret: replaySecret}
+		}
+		fmt.Printf("%s fetch, %d requests\n", taken.Format("2006-01-02 15:04:05"), len(f.Interactions))
+		if *account == Store.MainAccount {
+			checkMainTimetable(ctx, creds)
+		} else {
+			// stored, diffed and notified under the account like its scheduled fetches
+			BotStart.CheckAccount(Store.Account{UserID: *account, Username: "replay"}, creds)
+		}
+	}
+
+	changes, err := History.Changes(db, *account, time.Time{}, fetches[len(fetches)-1].Time)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d fetches replayed, %d changes\n", len(fetches), len(changes))
+	for _, c := range changes {
+		fmt.Printf("%s %s\n", c.Detected.Format("2006-01-02 15:04:05"), c)
+	}
+	return nil
+}
+
+// replayLessonTimes posts the next lesson at every lesson time after the
+// fake clock up to until
+func replayLessonTimes(fake *Clock.Fake, until time.Time) {
+	for t := fake.Now().Truncate(time.Minute).Add(time.Minute); !t.After(until); t = t.Add(time.Minute) {
+		if isScheduledTime(t) {
+			fake.Set(t)
+			fmt.Printf("%s lesson time\n", t.Format("2006-01-02 15:04:05"))
+			Run(t)
+		}
+	}
+}
+
+func printTimetable(entries []NamedTimetableEntry, asJSON bool) error {
+	if asJSON {
+		return printJSON(entries)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DATE\tTIME\tSUBJECT\tROOM\tCLASS\tSTATUS")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s-%s\t%s\t%s\t%s\t%s\n", e.Date, e.StartTime, e.EndTime,
+			strings.Join(e.Su, ", "), strings.Join(e.Ro, ", "), strings.Join(e.Kl, ", "), e.Code)
+	}
+	return w.Flush()
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
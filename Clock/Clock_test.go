@@ -0,0 +1,66 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2025, 9, 5, 13, 44, 0, 0, time.UTC)
+	f := NewFake(start)
+	if !f.Now().Equal(start) {
+		t.Fatalf("Now() = %s, want %s", f.Now(), start)
+	}
+	select {
+	case got := <-f.After(0):
+		if !got.Equal(start) {
+			t.Errorf("After(0) sent %s", got)
+		}
+	default:
+		t.Error("After(0) did not fire right away")
+	}
+
+	late := f.After(2 * time.Minute)
+	early := f.After(time.Minute)
+	f.Waiting(2)
+	f.Advance(59 * time.Second)
+	select {
+	case <-early:
+		t.Error("fired before its time")
+	default:
+	}
+	f.Advance(time.Second)
+	if got := <-early; !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("early fired at %s", got)
+	}
+	select {
+	case <-late:
+		t.Error("late fired with early")
+	default:
+	}
+	f.Set(start.Add(time.Hour))
+	if got := <-late; !got.Equal(start.Add(time.Hour)) {
+		t.Errorf("late fired at %s, want the time it was set to", got)
+	}
+
+	f.Set(start) // the clock never goes back
+	if !f.Now().Equal(start.Add(time.Hour)) {
+		t.Errorf("Now() after setting it back = %s", f.Now())
+	}
+}
+
+func TestFakeWaiting(t *testing.T) {
+	f := NewFake(time.Now())
+	done := make(chan struct{})
+	go func() {
+		<-f.After(time.Second)
+		close(done)
+	}()
+	f.Waiting(1)
+	f.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the goroutine was not woken")
+	}
+}
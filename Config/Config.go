@@ -0,0 +1,417 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything the bot can be configured with. It is read once at
+// startup from the config file, every value can be overridden by the
+// environment variable in its env tag (also from .env).
+type Config struct {
+	DataDir         string        `yaml:"data_dir" env:"DATA_DIR"`                 // where all files of the bot are kept
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"` // how long stopping may take
+	Untis           Untis         `yaml:"untis"`
+	Discord         Discord       `yaml:"discord"`
+	Notifiers       Notifiers     `yaml:"notifiers"`
+	Schedule        Schedule      `yaml:"schedule"`
+	QuietHours      QuietHours    `yaml:"quiet_hours"`
+	Storage         Storage       `yaml:"storage"`
+	HTTP            HTTP          `yaml:"http"`
+	Encryption      Encryption    `yaml:"encryption"`
+	Log             Log           `yaml:"log"`
+}
+
+// Untis is the school the bot talks to and the main account, whose timetable
+// is posted to the webhook. There is one of it, the other accounts are added
+// with !addaccount, kept in the store and have to be at the same school.
+type Untis struct {
+	Server   string `yaml:"server" env:"UNTIS_SERVER"` // host name like thalia.webuntis.com, or a URL like http://localhost:8081
+	School   string `yaml:"school" env:"UNTIS_SCHOOL"`
+	User     string `yaml:"user" env:"UNTIS_USER"`
+	Password string `yaml:"password" env:"UNTIS_PASSWORD"`
+	Secret   string `yaml:"secret" env:"UNTIS_SECRET"` // key of the WebUntis QR code, used instead of the password
+	Record   string `yaml:"record" env:"UNTIS_RECORD"` // cassette file all Untis requests and responses are appended to
+}
+
+type Discord struct {
+	Token      string   `yaml:"token" env:"DISCORD_BOT_TOKEN"`
+	AdminUsers []string `yaml:"admin_users" env:"ADMIN_USERS"` // user IDs of the bot operators
+}
+
+type Notifiers struct {
+	WebhookURL     string `yaml:"webhook_url" env:"DISCORD_WEBHOOK_URL"`
+	DirectMessages bool   `yaml:"direct_messages" env:"DIRECT_MESSAGES"` // DM users about changes of their timetable
+	DryRun         bool   `yaml:"dry_run" env:"DRY_RUN"`                 // print every notification instead of sending it
+	DryRunFile     string `yaml:"dry_run_file" env:"DRY_RUN_FILE"`       // file they are appended to instead of stdout
+}
+
+type Schedule struct {
+	LessonTimes        []string      `yaml:"lesson_times" env:"LESSON_TIMES"`     // when the next lesson is posted to the webhook
+	CheckInterval      time.Duration `yaml:"check_interval" env:"CHECK_INTERVAL"` // how often the timetables are fetched
+	Workers            int           `yaml:"workers" env:"FETCH_WORKERS"`
+	PerServer          int           `yaml:"per_server" env:"FETCH_PER_SERVER"`
+	JitterSeconds      int           `yaml:"jitter_seconds" env:"FETCH_JITTER_SECONDS"`
+	TimetableCacheTime time.Duration `yaml:"timetable_cache_time" env:"TIMETABLE_CACHE_TIME"` // how long the web server keeps a fetched timetable
+}
+
+// QuietHours is a time of the day no notifications are sent in, they are
+// delivered when it ends. Start may be after End to span midnight.
+type QuietHours struct {
+	Start string `yaml:"start" env:"QUIET_HOURS_START"`
+	End   string `yaml:"end" env:"QUIET_HOURS_END"`
+}
+
+type Storage struct {
+	Kind                  string `yaml:"kind" env:"STORE"` // json or bolt
+	Path                  string `yaml:"path" env:"STORE_PATH"`
+	SnapshotRetentionDays int    `yaml:"snapshot_retention_days" env:"SNAPSHOT_RETENTION_DAYS"`
+	SnapshotMax           int    `yaml:"snapshot_max" env:"SNAPSHOT_MAX"`
+	AuditRetentionDays    int    `yaml:"audit_retention_days" env:"AUDIT_RETENTION_DAYS"`
+}
+
+type HTTP struct {
+	Addr           string        `yaml:"addr" env:"HTTP_ADDR"`
+	PublicURL      string        `yaml:"public_url" env:"PUBLIC_URL"`
+	APIToken       string        `yaml:"api_token" env:"API_TOKEN"`
+	DashboardToken string        `yaml:"dashboard_token" env:"DASHBOARD_TOKEN"`
+	MetricsToken   string        `yaml:"metrics_token" env:"METRICS_TOKEN"` // /metrics needs it when set
+	IcalWeeks      int           `yaml:"ical_weeks" env:"ICAL_WEEKS"`
+	UnhealthyAfter time.Duration `yaml:"unhealthy_after" env:"UNHEALTHY_AFTER"` // /healthz fails when fetches fail for longer
+}
+
+type Encryption struct {
+	Key            string `yaml:"key" env:"ENC_KEY"`
+	Keys           string `yaml:"keys" env:"ENC_KEYS"`
+	KeyFile        string `yaml:"key_file" env:"ENC_KEY_FILE"`
+	Passphrase     string `yaml:"passphrase" env:"ENC_PASSPHRASE"`
+	PassphraseFile string `yaml:"passphrase_file" env:"ENC_PASSPHRASE_FILE"`
+	KDF            string `yaml:"kdf" env:"ENC_KDF"`
+	CredentialsDir string `yaml:"credentials_dir" env:"CREDENTIALS_DIRECTORY"` // set by systemd
+	AllowLegacy    bool   `yaml:"allow_legacy" env:"ENC_ALLOW_LEGACY"`         // decrypt the old formats after the upgrade
+}
+
+type Log struct {
+	Format string `yaml:"format" env:"LOG_FORMAT"` // text or json
+	Level  string `yaml:"level" env:"LOG_LEVEL"`   // debug, info, warn or error
+}
+
+// Default returns the configuration used for everything the file and the
+// environment do not set
+func Default() *Config {
+	return &Config{
+		DataDir:         ".",
+		ShutdownTimeout: 30 * time.Second,
+		Untis:           Untis{Server: "thalia.webuntis.com", School: "Mons_Tabor"},
+		Notifiers: Notifiers{
+			DirectMessages: true,
+		},
+		Schedule: Schedule{
+			LessonTimes:        []string{"07:45", "08:35", "09:35", "10:25", "11:25", "12:15", "13:45", "14:25"},
+			CheckInterval:      time.Minute,
+			Workers:            8,
+			PerServer:          4,
+			JitterSeconds:      30,
+			TimetableCacheTime: 15 * time.Minute,
+		},
+		Storage: Storage{Kind: "json", SnapshotRetentionDays: 90, SnapshotMax: 1000, AuditRetentionDays: 180},
+		HTTP:    HTTP{Addr: ":8080", IcalWeeks: 4, UnhealthyAfter: 30 * time.Minute},
+		Encryption: Encryption{
+			KDF: "argon2id",
+		},
+		Log: Log{Format: "text", Level: "info"},
+	}
+}
+
+// Load reads .env, the config file at path and the environment. Without a
+// path CONFIG_FILE is used, or config.yaml if it exists. Every problem found
+// is reported in the returned error.
+func Load(path string) (*Config, error) {
+	godotenv.Load(".env")
+	cfg := Default()
+
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path == "" {
+		if _, err := os.Stat("config.yaml"); err == nil {
+			path = "config.yaml"
+		}
+	}
+	if path != "" {
+		if err := cfg.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), ""); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		if path != "" {
+			return nil, fmt.Errorf("invalid config %s:\n%w", path, err)
+		}
+		return nil, fmt.Errorf("invalid config:\n%w", err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if line := untisList(data); line > 0 {
+		return fmt.Errorf("%s: line %d: untis is one school with the main account, not a list; add the other accounts with !addaccount", path, line)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)                                              // a misspelt key is an error instead of silently ignored
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) { // an empty file is fine
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 && len(cfg.Secrets()) > 0 {
+		slog.Warn("The config file contains passwords or tokens and can be read by other users, run chmod 600 on it", "path", path)
+	}
+	return nil
+}
+
+// untisList returns the line of the untis section if it is a list of
+// schools, 0 otherwise
+func untisList(data []byte) int {
+	var doc yaml.Node
+	if yaml.Unmarshal(data, &doc) != nil || len(doc.Content) == 0 {
+		return 0
+	}
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "untis" && root.Content[i+1].Kind == yaml.SequenceNode {
+			return root.Content[i+1].Line
+		}
+	}
+	return 0
+}
+
+// Secrets returns the passwords, tokens and keys that are set, so they can
+// be kept out of the log
+func (cfg *Config) Secrets() []string {
+	var secrets []string
+	for _, s := range []string{cfg.Untis.Password, cfg.Untis.Secret, cfg.Discord.Token, cfg.Notifiers.WebhookURL,
+		cfg.HTTP.APIToken, cfg.HTTP.DashboardToken, cfg.HTTP.MetricsToken,
+		cfg.Encryption.Key, cfg.Encryption.Keys, cfg.Encryption.Passphrase} {
+		if s != "" {
+			secrets = append(secrets, s)
+		}
+	}
+	return secrets
+}
+
+// applyEnv sets every field with an env tag whose variable is set
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(value, prefix+field.Tag.Get("yaml")+"."); err != nil {
+				return err
+			}
+			continue
+		}
+		name := field.Tag.Get("env")
+		env, ok := os.LookupEnv(name)
+		if name == "" || !ok || env == "" {
+			continue
+		}
+		if err := setFromString(value, env); err != nil {
+			return fmt.Errorf("%s (%s%s): %w", name, prefix, field.Tag.Get("yaml"), err)
+		}
+	}
+	return nil
+}
+
+func setFromString(v reflect.Value, s string) error {
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(s)
+	case []string:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like 90s or 15m", s)
+		}
+		v.SetInt(int64(d))
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", s)
+		}
+		v.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", s)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Validate checks the configuration and returns all problems at once
+func (cfg *Config) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if cfg.DataDir == "" {
+		fail("data_dir", "must not be empty, use . for the current folder")
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		fail("shutdown_timeout", "must be more than 0, e.g. 30s")
+	}
+	if cfg.Untis.Server == "" {
+		fail("untis.server", "is required, e.g. thalia.webuntis.com")
+	} else if _, err := url.Parse(cfg.Untis.URL()); err != nil {
+		fail("untis.server", "%q is not a host name or URL", cfg.Untis.Server)
+	}
+	if cfg.Untis.School == "" {
+		fail("untis.school", "is required, it is the school= part of the WebUntis address")
+	}
+	if cfg.Untis.User != "" && cfg.Untis.Password == "" && cfg.Untis.Secret == "" {
+		fail("untis.password", "is required for untis.user, or set untis.secret")
+	}
+	if cfg.Untis.Secret != "" && !validSecret(cfg.Untis.Secret) {
+		fail("untis.secret", "is not the base32 key of a WebUntis QR code")
+	}
+
+	if u := cfg.Notifiers.WebhookURL; u != "" && !strings.HasPrefix(u, "https://") {
+		fail("notifiers.webhook_url", "must be an https:// address")
+	}
+
+	for i, t := range cfg.Schedule.LessonTimes {
+		if !validTime(t) {
+			fail(fmt.Sprintf("schedule.lesson_times[%d]", i), "%q is not a time like 07:45", t)
+		}
+	}
+	if cfg.Schedule.CheckInterval < 10*time.Second {
+		fail("schedule.check_interval", "must be at least 10s, is %s", cfg.Schedule.CheckInterval)
+	}
+	if cfg.Schedule.Workers < 1 {
+		fail("schedule.workers", "must be at least 1")
+	}
+	if cfg.Schedule.PerServer < 0 {
+		fail("schedule.per_server", "must not be negative")
+	}
+	if cfg.Schedule.JitterSeconds < 0 {
+		fail("schedule.jitter_seconds", "must not be negative")
+	}
+	if cfg.Schedule.TimetableCacheTime < 0 {
+		fail("schedule.timetable_cache_time", "must not be negative")
+	}
+
+	if (cfg.QuietHours.Start == "") != (cfg.QuietHours.End == "") {
+		fail("quiet_hours", "needs both start and end")
+	}
+	for field, t := range map[string]string{"quiet_hours.start": cfg.QuietHours.Start, "quiet_hours.end": cfg.QuietHours.End} {
+		if t != "" && !validTime(t) {
+			fail(field, "%q is not a time like 22:00", t)
+		}
+	}
+
+	if cfg.Storage.Kind != "json" && cfg.Storage.Kind != "bolt" {
+		fail("storage.kind", "%q is unknown, use json or bolt", cfg.Storage.Kind)
+	}
+	for field, n := range map[string]int{
+		"storage.snapshot_retention_days": cfg.Storage.SnapshotRetentionDays,
+		"storage.snapshot_max":            cfg.Storage.SnapshotMax,
+		"storage.audit_retention_days":    cfg.Storage.AuditRetentionDays,
+	} {
+		if n < 0 {
+			fail(field, "must not be negative, use 0 for no limit")
+		}
+	}
+
+	if cfg.HTTP.Addr == "" {
+		fail("http.addr", "must not be empty, e.g. :8080")
+	}
+	if cfg.HTTP.PublicURL != "" {
+		u, err := url.Parse(cfg.HTTP.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("http.public_url", "%q is not an address like https://untis.example.com", cfg.HTTP.PublicURL)
+		}
+	}
+	if cfg.HTTP.IcalWeeks < 1 || cfg.HTTP.IcalWeeks > 52 {
+		fail("http.ical_weeks", "must be between 1 and 52")
+	}
+	if cfg.HTTP.UnhealthyAfter < cfg.Schedule.CheckInterval {
+		fail("http.unhealthy_after", "must be at least schedule.check_interval (%s)", cfg.Schedule.CheckInterval)
+	}
+
+	if cfg.Encryption.KDF != "argon2id" && cfg.Encryption.KDF != "scrypt" {
+		fail("encryption.kdf", "%q is unknown, use argon2id or scrypt", cfg.Encryption.KDF)
+	}
+	if cfg.Encryption.Key != "" && cfg.Encryption.Keys != "" {
+		fail("encryption.key", "can not be used together with encryption.keys, list it there")
+	}
+
+	if cfg.Log.Format != "text" && cfg.Log.Format != "json" {
+		fail("log.format", "%q is unknown, use text or json", cfg.Log.Format)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		fail("log.level", "%q is unknown, use debug, info, warn or error", cfg.Log.Level)
+	}
+	return errors.Join(errs...)
+}
+
+func validTime(t string) bool {
+	_, err := time.Parse("15:04", t)
+	return err == nil && len(t) == 5
+}
+
+func validSecret(secret string) bool {
+	secret = strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "="))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	return err == nil && len(key) > 0
+}
+
+// URL returns the JSON-RPC address of the school
+func (u Untis) URL() string {
+	base := u.Server
+	if !strings.Contains(base, "://") {
+		base = "https://" + base
+	}
+	return strings.TrimRight(base, "/") + "/WebUntis/jsonrpc.do?school=" + url.QueryEscape(u.School)
+}
+
+// InQuietHours reports whether no notifications should be sent at t
+func (q QuietHours) InQuietHours(t time.Time) bool {
+	if q.Start == "" || q.End == "" {
+		return false
+	}
+	now := t.Format("15:04")
+	if q.Start <= q.End {
+		return now >= q.Start && now < q.End
+	}
+	return now >= q.Start || now < q.End
+}
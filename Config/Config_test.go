@@ -0,0 +1,29 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUntisList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "untis:\n  - server: a.webuntis.com\n    school: A\n  - server: b.webuntis.com\n    school: B\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Load(path)
+	if err == nil || !strings.Contains(err.Error(), "line 2") || !strings.Contains(err.Error(), "!addaccount") {
+		t.Errorf("Load() of a list of schools = %v, want an error pointing at !addaccount", err)
+	}
+
+	data = "untis:\n  server: a.webuntis.com\n  school: A\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil || cfg.Untis.School != "A" {
+		t.Errorf("Load() = %+v, %v", cfg, err)
+	}
+}
@@ -0,0 +1,145 @@
+package history
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+	Untis "untislogger/Bot"
+	Metrics "untislogger/Metrics"
+	Store "untislogger/Store"
+)
+
+var mutex sync.Mutex // serializes recording and pruning
+
+// Maximum age and number of snapshots kept per account, 0 keeps them forever
+var (
+	maxAge       = 90 * 24 * time.Hour
+	maxSnapshots = 1000
+)
+
+// SetRetention sets how many days and how many snapshots are kept per account
+func SetRetention(days, max int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	maxAge = time.Duration(days) * 24 * time.Hour
+	maxSnapshots = max
+}
+
+func retention() (time.Duration, int) {
+	return maxAge, maxSnapshots
+}
+
+// Record stores entries as a new snapshot of account when they differ from
+// the latest one and returns the changes against it. The first snapshot of an
+// account has no changes.
+func Record(st Store.Store, account string, entries []Untis.NamedTimetableEntry, taken time.Time) ([]Untis.Change, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	prev, found, err := latest(st, account)
+	if err != nil {
+		return nil, err
+	}
+	snap := Store.Snapshot{Account: account, Taken: taken, Entries: entries}
+	if found {
+		prevData, _ := json.Marshal(prev.Entries)
+		newData, _ := json.Marshal(entries)
+		if string(prevData) == string(newData) {
+			return nil, nil
+		}
+		snap.Changes = Untis.Diff(prev.Entries, entries, taken)
+		for _, change := range snap.Changes {
+			Metrics.TimetableChanges.Inc(change.Kind)
+		}
+	}
+	if err := st.SaveSnapshot(snap); err != nil {
+		return nil, err
+	}
+	prune(st, account, taken)
+	return snap.Changes, nil
+}
+
+func latest(st Store.Store, account string) (Store.Snapshot, bool, error) {
+	times, err := st.SnapshotTimes(account)
+	if err != nil || len(times) == 0 {
+		return Store.Snapshot{}, false, err
+	}
+	snap, err := st.Snapshot(account, times[len(times)-1])
+	return snap, err == nil, err
+}
+
+// prune removes snapshots past the retention limits, the newest one is always kept
+func prune(st Store.Store, account string, now time.Time) {
+	maxAge, max := retention()
+	times, err := st.SnapshotTimes(account)
+	if err != nil {
+		return
+	}
+	for i, taken := range times[:len(times)-1] {
+		tooOld := maxAge > 0 && now.Sub(taken) > maxAge
+		tooMany := max > 0 && len(times)-i > max
+		if tooOld || tooMany {
+			st.DeleteSnapshot(account, taken)
+		}
+	}
+}
+
+// Info describes a stored snapshot without its lessons
+type Info struct {
+	Taken   time.Time `json:"taken"`
+	Lessons int       `json:"lessons"`
+	Changes int       `json:"changes"`
+}
+
+// List describes all stored snapshots of an account, oldest first
+func List(st Store.Store, account string) ([]Info, error) {
+	times, err := st.SnapshotTimes(account)
+	if err != nil {
+		return nil, err
+	}
+	infos := []Info{}
+	for _, taken := range times {
+		snap, err := st.Snapshot(account, taken)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, Info{Taken: snap.Taken, Lessons: len(snap.Entries), Changes: len(snap.Changes)})
+	}
+	return infos, nil
+}
+
+// At returns the snapshot of an account that was current at t, the one taken
+// last before or at t.
+func At(st Store.Store, account string, t time.Time) (Store.Snapshot, bool, error) {
+	times, err := st.SnapshotTimes(account)
+	if err != nil {
+		return Store.Snapshot{}, false, err
+	}
+	for i := len(times) - 1; i >= 0; i-- {
+		if !times[i].After(t) {
+			snap, err := st.Snapshot(account, times[i])
+			return snap, err == nil, err
+		}
+	}
+	return Store.Snapshot{}, false, nil
+}
+
+// Changes returns the changes of an account detected between from and to, oldest first
+func Changes(st Store.Store, account string, from, to time.Time) ([]Untis.Change, error) {
+	times, err := st.SnapshotTimes(account)
+	if err != nil {
+		return nil, err
+	}
+	changes := []Untis.Change{}
+	for _, taken := range times {
+		if taken.Before(from) || taken.After(to) {
+			continue
+		}
+		snap, err := st.Snapshot(account, taken)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, snap.Changes...)
+	}
+	return changes, nil
+}
@@ -0,0 +1,289 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Redacted replaces secrets in the log
+const Redacted = "[REDACTED]"
+
+var (
+	level   = new(slog.LevelVar)
+	current atomic.Pointer[slog.Handler] // the text or JSON handler set by Setup
+
+	secretsMutex sync.RWMutex
+	secrets      = make(map[string]int)      // value -> number of owners
+	owned        = make(map[string][]string) // owner -> its values, "" for the ones of AddSecret
+)
+
+// Secrets shorter than this are only redacted as whole words, so a short
+// password does not cut up unrelated text
+const shortSecret = 8
+
+func init() {
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	current.Store(&h)
+	// log.Printf of the standard library, also used by discordgo, goes through
+	// the redaction as well
+	slog.SetDefault(slog.New(&handler{}))
+}
+
+// Setup sets the output format, text or json, and the lowest level that is
+// logged. Loggers made with For before Setup use it as well.
+func Setup(w io.Writer, format, lvl string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(lvl)); err != nil {
+		return fmt.Errorf("log level %q is unknown, use debug, info, warn or error", lvl)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch format {
+	case "text", "":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("log format %q is unknown, use text or json", format)
+	}
+	level.Set(l)
+	current.Store(&h)
+	return nil
+}
+
+// For returns the logger of a subsystem like untis, bot or web
+func For(subsystem string) *slog.Logger {
+	return slog.Default().With("subsystem", subsystem)
+}
+
+// AddSecret makes sure the values never show up in the log, e.g. passwords
+// and tokens from the config
+func AddSecret(values ...string) {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	setSecrets("", append(owned[""], values...))
+}
+
+// SetSecrets replaces the values kept out of the log for owner, e.g. the
+// password of an account. Setting the same values again changes nothing.
+func SetSecrets(owner string, values ...string) {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	setSecrets(owner, values)
+}
+
+// RemoveSecrets forgets the values of owner, e.g. when its account was removed
+func RemoveSecrets(owner string) {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	setSecrets(owner, nil)
+}
+
+// setSecrets replaces the values of owner, secretsMutex has to be held
+func setSecrets(owner string, values []string) {
+	var kept []string
+	for _, v := range values {
+		if v != "" && !slices.Contains(kept, v) {
+			kept = append(kept, v)
+		}
+	}
+	if slices.Equal(kept, owned[owner]) {
+		return
+	}
+	for _, v := range owned[owner] {
+		if secrets[v]--; secrets[v] == 0 {
+			delete(secrets, v)
+		}
+	}
+	for _, v := range kept {
+		secrets[v]++
+	}
+	if len(kept) == 0 {
+		delete(owned, owner)
+	} else {
+		owned[owner] = kept
+	}
+}
+
+type ctxKey struct{}
+
+// With returns a context whose log entries get the attributes, like the
+// account or the Untis method a request belongs to. An attribute that is
+// already set is replaced.
+func With(ctx context.Context, args ...any) context.Context {
+	r := slog.NewRecord(time.Time{}, 0, "", 0)
+	r.Add(args...)
+	old, _ := ctx.Value(ctxKey{}).([]slog.Attr)
+	attrs := make([]slog.Attr, 0, len(old)+r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	for _, a := range old {
+		if !hasKey(attrs, a.Key) {
+			attrs = append(attrs, a)
+		}
+	}
+	return context.WithValue(ctx, ctxKey{}, attrs)
+}
+
+// Get returns the value of an attribute set with With, like the account a
+// request belongs to
+func Get(ctx context.Context, key string) (string, bool) {
+	attrs, _ := ctx.Value(ctxKey{}).([]slog.Attr)
+	for _, a := range attrs {
+		if a.Key == key {
+			return a.Value.String(), true
+		}
+	}
+	return "", false
+}
+
+func hasKey(attrs []slog.Attr, key string) bool {
+	for _, a := range attrs {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// handler redacts every record and passes it on to the handler set by Setup
+type handler struct {
+	ops []func(slog.Handler) slog.Handler // WithAttrs and WithGroup, replayed on the current handler
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	next := *current.Load()
+	for _, op := range h.ops {
+		next = op(next)
+	}
+	out := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	if attrs, ok := ctx.Value(ctxKey{}).([]slog.Attr); ok {
+		out.AddAttrs(redactAttrs(attrs)...)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return next.Handle(ctx, out)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	attrs = redactAttrs(attrs)
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) slog.Handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{ops: append(ops, op)}
+}
+
+// Attribute keys whose values are never logged
+var secretKeys = []string{"password", "passwd", "secret", "token", "session", "cookie", "authorization", "webhook", "passphrase", "otp"}
+
+func redactAttrs(attrs []slog.Attr) []slog.Attr {
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		out[i] = redactAttr(a)
+	}
+	return out
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	key := strings.ToLower(a.Key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) && v.Kind() != slog.KindGroup {
+			return slog.String(a.Key, Redacted)
+		}
+	}
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(v.String()))
+	case slog.KindGroup:
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redactAttrs(v.Group())...)}
+	case slog.KindAny:
+		// errors, structs and slices are logged as their redacted text
+		return slog.String(a.Key, Redact(fmt.Sprintf("%+v", v.Any())))
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+var patterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Discord webhooks, the ID and the token after /api/webhooks/ are the secret
+	{regexp.MustCompile(`(?i)(/api/webhooks/)[^\s"'<>]+`), "${1}" + Redacted},
+	// calendar feed addresses, the token in them is the only login
+	{regexp.MustCompile(`(/ical/)[^\s"'?]+`), "${1}" + Redacted},
+	{regexp.MustCompile(`(?i)(JSESSIONID=)[^;\s"']+`), "${1}" + Redacted},
+	{regexp.MustCompile(`(?i)((?:Bearer|Authorization:?\s*Bot)\s+)[A-Za-z0-9._~+/=-]{8,}`), "${1}" + Redacted},
+	// "sessionId":"…", password=… and the like in JSON bodies and query strings
+	{regexp.MustCompile(`(?i)("?(?:sessionId|password|secret|token|otp)"?\s*[:=]\s*"?)[^"\s,;&}]+`), "${1}" + Redacted},
+}
+
+// Redact removes webhook URLs, tokens, passwords, session IDs and the values
+// given to AddSecret from s
+func Redact(s string) string {
+	secretsMutex.RLock()
+	for secret := range secrets {
+		if len(secret) < shortSecret {
+			s = replaceWord(s, secret)
+		} else {
+			s = strings.ReplaceAll(s, secret, Redacted)
+		}
+	}
+	secretsMutex.RUnlock()
+	for _, p := range patterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// replaceWord redacts the places where secret is not part of a longer word
+func replaceWord(s, secret string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, secret)
+		if i < 0 {
+			break
+		}
+		before, _ := utf8.DecodeLastRuneInString(s[:i])
+		after, _ := utf8.DecodeRuneInString(s[i+len(secret):])
+		b.WriteString(s[:i])
+		if (i > 0 && isWord(before)) || (i+len(secret) < len(s) && isWord(after)) {
+			b.WriteString(secret)
+		} else {
+			b.WriteString(Redacted)
+		}
+		s = s[i+len(secret):]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+func isWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
@@ -0,0 +1,41 @@
+package logging
+
+import "testing"
+
+func TestRedactSecrets(t *testing.T) {
+	defer func() {
+		RemoveSecrets("")
+		RemoveSecrets("42")
+	}()
+	AddSecret("config-token-value")
+	SetSecrets("42", "abc", "long-password")
+
+	tests := []struct {
+		in, want string
+	}{
+		{"token config-token-value", "token " + Redacted},
+		{"login with long-password failed", "login with " + Redacted + " failed"},
+		{"user abc logged in", "user " + Redacted + " logged in"},
+		{"(abc)", "(" + Redacted + ")"},
+		{"abcdef and xabc are other words", "abcdef and xabc are other words"},
+	}
+	for _, tt := range tests {
+		if got := Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	// a new password replaces the old one, removing the account forgets it
+	SetSecrets("42", "new-password")
+	SetSecrets("42", "new-password")
+	if got := Redact("long-password new-password"); got != "long-password "+Redacted {
+		t.Errorf("after the password changed Redact() = %q", got)
+	}
+	if len(secrets) != 2 {
+		t.Errorf("%d secrets kept, want 2", len(secrets))
+	}
+	RemoveSecrets("42")
+	if got := Redact("new-password"); got != "new-password" {
+		t.Errorf("after removing the account Redact() = %q", got)
+	}
+}
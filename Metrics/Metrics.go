@@ -0,0 +1,208 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// All metrics of the bot, written by Write in the Prometheus text format
+var (
+	UntisRequests = NewCounter("untislogger_untis_requests_total",
+		"Untis JSON-RPC calls by method and result (ok, error, http_error, rpc_error).", "method", "result")
+	UntisRequestDuration = NewHistogram("untislogger_untis_request_duration_seconds",
+		"Duration of Untis JSON-RPC calls by method.", []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "method")
+	AuthFailures = NewCounter("untislogger_untis_auth_failures_total",
+		"Failed Untis logins by login method (password or secret).", "login")
+	Fetches = NewCounter("untislogger_fetches_total",
+		"Timetable fetches of accounts by result (ok or error).", "result")
+	FetchDuration = NewHistogram("untislogger_fetch_duration_seconds",
+		"Duration of timetable fetches including the login.", []float64{0.25, 0.5, 1, 2.5, 5, 10, 30, 60}, "result")
+	TimetableChanges = NewCounter("untislogger_timetable_changes_total",
+		"Timetable changes detected by kind (added, removed, cancelled, changed).", "kind")
+	Notifications = NewCounter("untislogger_notifications_total",
+		"Notifications by notifier and result (sent, failed, dropped or dry_run).", "notifier", "result")
+	DiscordCommands = NewCounter("untislogger_discord_commands_total",
+		"Discord commands handled by command.", "command")
+	SchedulerLag = NewHistogram("untislogger_scheduler_lag_seconds",
+		"How late scheduled work started by scheduler (minute or pool).", []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300}, "scheduler")
+	Errors = NewCounter("untislogger_errors_total",
+		"Errors by source (fetch, notifier or discord).", "source")
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      []metric
+)
+
+func register(m metric) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry = append(registry, m)
+}
+
+// Write writes all metrics in the Prometheus text exposition format
+func Write(w io.Writer) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	for _, m := range registry {
+		m.write(w)
+	}
+}
+
+// Counter is a value that only goes up, one per combination of label values
+type Counter struct {
+	name, help string
+	labels     []string
+
+	mutex  sync.Mutex
+	values map[string]float64 // label values joined by \xff -> value
+}
+
+// NewCounter creates and registers a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// Inc adds 1 to the counter of the label values, given in the order of the names
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter of the label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[key] += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelPairs(c.labels, key, ""), formatValue(c.values[key]))
+	}
+}
+
+// Histogram counts observations in buckets, one per combination of label values
+type Histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // upper bounds, sorted
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates and registers a histogram with the given bucket upper
+// bounds and label names
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	sort.Float64s(buckets)
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	register(h)
+	return h
+}
+
+// Observe adds v to the histogram of the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &series{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// ObserveDuration adds d in seconds
+func (h *Histogram) ObserveDuration(d time.Duration, labelValues ...string) {
+	h.Observe(d.Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, key, formatValue(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, key, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, key, ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, key, ""), s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelPairs formats the labels like {method="getRooms",result="ok"}, le is
+// added for histogram buckets when it is not empty
+func labelPairs(names []string, key, le string) string {
+	var pairs []string
+	if len(names) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, name := range names {
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			pairs = append(pairs, name+`="`+escape(value)+`"`)
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,199 @@
+package mock
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+)
+
+// The demo school used when no fixture directory is given, and for every
+// file missing in it
+//
+//go:embed fixtures/*.json
+var defaults embed.FS
+
+// Fixtures is everything the fake server knows, each part is one file of
+// the fixture directory
+type Fixtures struct {
+	Users    []User        // users.json
+	Rooms    []Element     // rooms.json
+	Klassen  []Element     // klassen.json
+	Subjects []Element     // subjects.json
+	Teachers []Element     // teachers.json
+	Lessons  []Lesson      // timetable.json
+	Timegrid []TimegridDay // timegrid.json
+	Holidays []Holiday     // holidays.json
+	Changes  []Change      // script.json
+	Faults   []Fault       // script.json
+}
+
+// User can log in with the password, or with one time passwords made from
+// the secret like the Untis app does
+type User struct {
+	Name       string `json:"user"`
+	Password   string `json:"password,omitempty"`
+	Secret     string `json:"secret,omitempty"` // base32, the key of the QR code
+	PersonID   int    `json:"personId"`
+	PersonType int    `json:"personType"` // 5 is a student
+	KlasseID   int    `json:"klasseId"`
+}
+
+// Element is a room, class, subject or teacher as getRooms and the like return it
+type Element struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	LongName      string `json:"longName"`
+	Active        bool   `json:"active"`
+	AlternateName string `json:"alternateName,omitempty"`
+	Building      string `json:"building,omitempty"`
+	Teacher1      int    `json:"teacher1,omitempty"`
+}
+
+// Lesson takes place every week on the weekdays, or once on the date
+type Lesson struct {
+	ID           int    `json:"id"`
+	Weekdays     []int  `json:"weekdays,omitempty"` // 1 is Monday, 7 is Sunday
+	Date         string `json:"date,omitempty"`     // 2025-09-01, today or tomorrow
+	StartTime    int    `json:"startTime"`          // like 745 for 07:45
+	EndTime      int    `json:"endTime"`
+	Code         string `json:"code,omitempty"` // cancelled or irregular
+	Kl           []int  `json:"kl,omitempty"`
+	Su           []int  `json:"su,omitempty"`
+	Ro           []int  `json:"ro,omitempty"`
+	Te           []int  `json:"te,omitempty"`
+	ActivityType string `json:"activityType,omitempty"`
+}
+
+// Change is a scripted change of the timetable, it applies from After on,
+// counted from the start of the server. Only the fields that are set change.
+type Change struct {
+	After     Duration `json:"after"`
+	Lesson    int      `json:"lesson"`         // id of the lesson in timetable.json
+	Date      string   `json:"date,omitempty"` // only this day, like Lesson.Date; every day if empty
+	Code      string   `json:"code,omitempty"` // cancelled, irregular or regular
+	StartTime int      `json:"startTime,omitempty"`
+	EndTime   int      `json:"endTime,omitempty"`
+	Su        []int    `json:"su,omitempty"`
+	Ro        []int    `json:"ro,omitempty"`
+	Te        []int    `json:"te,omitempty"`
+	Remove    bool     `json:"remove,omitempty"` // the lesson disappears
+	Add       *Lesson  `json:"add,omitempty"`    // a new lesson appears, Lesson is ignored
+}
+
+// Fault makes calls of a method fail, from After until Until (counted from
+// the start of the server, 0 for no end) and at most Times times (0 for no
+// limit). Status answers with that HTTP status, Code with a JSON-RPC error,
+// Delay answers late.
+type Fault struct {
+	Method  string   `json:"method,omitempty"` // e.g. getTimetable, authenticate or getUserData2017; every method if empty
+	After   Duration `json:"after,omitempty"`
+	Until   Duration `json:"until,omitempty"`
+	Times   int      `json:"times,omitempty"`
+	Status  int      `json:"status,omitempty"`
+	Code    int      `json:"code,omitempty"`
+	Message string   `json:"message,omitempty"`
+	Delay   Duration `json:"delay,omitempty"`
+}
+
+type TimegridDay struct {
+	Day       int `json:"day"` // 1 is Sunday, 2 Monday
+	TimeUnits []struct {
+		Name      string `json:"name"`
+		StartTime int    `json:"startTime"`
+		EndTime   int    `json:"endTime"`
+	} `json:"timeUnits"`
+}
+
+type Holiday struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	LongName  string `json:"longName"`
+	StartDate int    `json:"startDate"` // like 20251222
+	EndDate   int    `json:"endDate"`
+}
+
+// Duration is a time.Duration written like 5m or 1h30m in the fixtures
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations are written like \"5m\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Default returns the fixtures of the demo school
+func Default() Fixtures {
+	var f Fixtures
+	if err := f.load(defaults, "fixtures"); err != nil {
+		panic(err) // the embedded files are broken
+	}
+	return f
+}
+
+// Load reads the fixtures in dir, files that are not there are taken from
+// the demo school
+func Load(dir string) (Fixtures, error) {
+	if info, err := os.Stat(dir); err != nil {
+		return Fixtures{}, err
+	} else if !info.IsDir() {
+		return Fixtures{}, fmt.Errorf("%s is not a directory", dir)
+	}
+	f := Default()
+	if err := f.load(os.DirFS(dir), "."); err != nil {
+		return Fixtures{}, err
+	}
+	return f, nil
+}
+
+func (f *Fixtures) load(fsys fs.FS, dir string) error {
+	var script struct {
+		Changes []Change `json:"changes"`
+		Faults  []Fault  `json:"faults"`
+	}
+	files := []struct {
+		name string
+		v    interface{}
+	}{
+		{"users.json", &f.Users},
+		{"rooms.json", &f.Rooms},
+		{"klassen.json", &f.Klassen},
+		{"subjects.json", &f.Subjects},
+		{"teachers.json", &f.Teachers},
+		{"timetable.json", &f.Lessons},
+		{"timegrid.json", &f.Timegrid},
+		{"holidays.json", &f.Holidays},
+		{"script.json", &script},
+	}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, path.Join(dir, file.name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, file.v); err != nil {
+			return fmt.Errorf("%s: %w", file.name, err)
+		}
+		if file.name == "script.json" {
+			f.Changes, f.Faults = script.Changes, script.Faults
+		}
+	}
+	return nil
+}
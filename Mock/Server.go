@@ -0,0 +1,529 @@
+package mock
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JSON-RPC error codes the real server answers with
+const (
+	codeBadCredentials   = -8504
+	codeNotAuthenticated = -8520
+	codeInvalidParams    = -32602
+	codeUnknownMethod    = -32601
+)
+
+// Server is a fake WebUntis server answering like thalia.webuntis.com, for
+// development without a school account and for tests. Point untis.server at
+// its address, any school name is accepted.
+type Server struct {
+	now      func() time.Time // the clock of the script and of one time passwords
+	fixtures Fixtures
+	started  time.Time
+
+	mutex    sync.Mutex
+	sessions map[string]User // JSESSIONID -> user
+	faults   []*fault
+	calls    map[string]int // method -> number of calls
+}
+
+type fault struct {
+	Fault
+	left int // calls left to fail when Times is set
+}
+
+// New returns a server answering with the fixtures, the script starts now.
+// now is the clock of the script and of the one time passwords, time.Now if
+// nil; tests can pass their own to move through the script.
+func New(f Fixtures, now func() time.Time) *Server {
+	if now == nil {
+		now = time.Now
+	}
+	s := &Server{now: now, fixtures: f, started: now(), sessions: make(map[string]User), calls: make(map[string]int)}
+	for _, flt := range f.Faults {
+		s.Inject(flt)
+	}
+	return s
+}
+
+// Schedule adds a change to the script, After is counted from the start of the server
+func (s *Server) Schedule(c Change) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fixtures.Changes = append(s.fixtures.Changes, c)
+}
+
+// Inject adds a fault, After and Until are counted from the start of the server
+func (s *Server) Inject(f Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = append(s.faults, &fault{Fault: f, left: f.Times})
+}
+
+// Calls returns how often a method was called, also the failed calls
+func (s *Server) Calls(method string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls[method]
+}
+
+type rpcRequest struct {
+	ID     string          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/jsonrpc.do") && r.Method == http.MethodPost:
+		s.handleRPC(w, r)
+	case strings.HasSuffix(r.URL.Path, "/jsonrpc_intern.do") && r.Method == http.MethodPost:
+		s.handleIntern(w, r)
+	case strings.HasSuffix(r.URL.Path, "/api/app/config") && r.Method == http.MethodGet:
+		s.handleAppConfig(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleRPC(w http.ResponseWriter, r *http.Request) {
+	var req rpcRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !s.prepare(w, r, req.ID, req.Method) {
+		return
+	}
+	if req.Method == "authenticate" {
+		s.authenticate(w, req)
+		return
+	}
+	user, ok := s.session(r)
+	if !ok {
+		writeError(w, req.ID, codeNotAuthenticated, "not authenticated")
+		return
+	}
+	switch req.Method {
+	case "logout":
+		if cookie, err := r.Cookie("JSESSIONID"); err == nil {
+			s.mutex.Lock()
+			delete(s.sessions, cookie.Value)
+			s.mutex.Unlock()
+		}
+		writeResult(w, req.ID, nil)
+	case "getRooms":
+		writeResult(w, req.ID, s.fixtures.Rooms)
+	case "getKlassen":
+		writeResult(w, req.ID, s.fixtures.Klassen)
+	case "getSubjects":
+		writeResult(w, req.ID, s.fixtures.Subjects)
+	case "getTeachers":
+		writeResult(w, req.ID, s.fixtures.Teachers)
+	case "getTimegridUnits":
+		writeResult(w, req.ID, s.fixtures.Timegrid)
+	case "getHolidays":
+		writeResult(w, req.ID, s.fixtures.Holidays)
+	case "getTimetable":
+		s.getTimetable(w, req, user)
+	default:
+		writeError(w, req.ID, codeUnknownMethod, "method not found")
+	}
+}
+
+// prepare counts the call and applies the faults of the method, it returns
+// false when a fault answered instead
+func (s *Server) prepare(w http.ResponseWriter, r *http.Request, id, method string) bool {
+	s.mutex.Lock()
+	s.calls[method]++
+	f := s.fault(method)
+	s.mutex.Unlock()
+	if f == nil {
+		return true
+	}
+	if f.Delay > 0 {
+		select {
+		case <-time.After(time.Duration(f.Delay)):
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	switch {
+	case f.Status != 0:
+		http.Error(w, http.StatusText(f.Status), f.Status)
+		return false
+	case f.Code != 0:
+		message := f.Message
+		if message == "" {
+			message = "injected error"
+		}
+		writeError(w, id, f.Code, message)
+		return false
+	}
+	return true
+}
+
+// fault returns the first fault that applies to the call, s.mutex has to be held
+func (s *Server) fault(method string) *fault {
+	elapsed := s.now().Sub(s.started)
+	for _, f := range s.faults {
+		if f.Method != "" && f.Method != method {
+			continue
+		}
+		if elapsed < time.Duration(f.After) || (f.Until > 0 && elapsed >= time.Duration(f.Until)) {
+			continue
+		}
+		if f.Times > 0 {
+			if f.left == 0 {
+				continue
+			}
+			f.left--
+		}
+		return f
+	}
+	return nil
+}
+
+func (s *Server) authenticate(w http.ResponseWriter, req rpcRequest) {
+	var params struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		writeError(w, req.ID, codeInvalidParams, "invalid params")
+		return
+	}
+	for _, user := range s.fixtures.Users {
+		if user.Name == params.User && user.Password != "" && user.Password == params.Password {
+			id := s.login(w, user)
+			writeResult(w, req.ID, map[string]interface{}{
+				"sessionId": id, "personType": user.PersonType, "personId": user.PersonID, "klasseId": user.KlasseID,
+			})
+			return
+		}
+	}
+	writeError(w, req.ID, codeBadCredentials, "bad credentials")
+}
+
+// handleIntern answers getUserData2017, the login of the Untis app with a
+// one time password
+func (s *Server) handleIntern(w http.ResponseWriter, r *http.Request) {
+	var req rpcRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	method := r.URL.Query().Get("m")
+	if method == "" {
+		method = req.Method
+	}
+	if !s.prepare(w, r, req.ID, method) {
+		return
+	}
+	if method != "getUserData2017" {
+		writeError(w, req.ID, codeUnknownMethod, "method not found")
+		return
+	}
+	var params []struct {
+		Auth struct {
+			User string `json:"user"`
+			OTP  int    `json:"otp"`
+		} `json:"auth"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil || len(params) == 0 {
+		writeError(w, req.ID, codeInvalidParams, "invalid params")
+		return
+	}
+	auth := params[0].Auth
+	now := s.now()
+	for _, user := range s.fixtures.Users {
+		if user.Name != auth.User || user.Secret == "" {
+			continue
+		}
+		// like the real server, the code of the previous and next 30 seconds is accepted too
+		for _, t := range []time.Time{now, now.Add(-30 * time.Second), now.Add(30 * time.Second)} {
+			if code, ok := totp(user.Secret, t); ok && code == auth.OTP {
+				s.login(w, user)
+				writeResult(w, req.ID, map[string]interface{}{"masterData": map[string]interface{}{}})
+				return
+			}
+		}
+	}
+	writeError(w, req.ID, codeBadCredentials, "bad credentials")
+}
+
+func (s *Server) handleAppConfig(w http.ResponseWriter, r *http.Request) {
+	if !s.prepare(w, r, "", "appConfig") {
+		return
+	}
+	user, ok := s.session(r)
+	if !ok {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return
+	}
+	person := map[string]interface{}{"id": user.PersonID, "type": user.PersonType}
+	writeJSON(w, map[string]interface{}{
+		"data": map[string]interface{}{
+			"loginServiceConfig": map[string]interface{}{
+				"user": map[string]interface{}{"personId": user.PersonID, "name": user.Name, "persons": []interface{}{person}},
+			},
+		},
+	})
+}
+
+// login starts a session of the user and sets its cookie
+func (s *Server) login(w http.ResponseWriter, user User) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := strings.ToUpper(hex.EncodeToString(b))
+	s.mutex.Lock()
+	s.sessions[id] = user
+	s.mutex.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: id, Path: "/WebUntis", HttpOnly: true})
+	return id
+}
+
+func (s *Server) session(r *http.Request) (User, bool) {
+	cookie, err := r.Cookie("JSESSIONID")
+	if err != nil {
+		return User{}, false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, ok := s.sessions[cookie.Value]
+	return user, ok
+}
+
+type idObj struct {
+	ID int `json:"id"`
+}
+
+type entry struct {
+	ID           int     `json:"id"`
+	Date         int     `json:"date"`
+	StartTime    int     `json:"startTime"`
+	EndTime      int     `json:"endTime"`
+	Code         string  `json:"code,omitempty"`
+	Kl           []idObj `json:"kl"`
+	Te           []idObj `json:"te"`
+	Su           []idObj `json:"su"`
+	Ro           []idObj `json:"ro"`
+	ActivityType string  `json:"activityType"`
+}
+
+// The longest range getTimetable answers, the real server refuses long ones too
+const maxTimetableDays = 366
+
+func (s *Server) getTimetable(w http.ResponseWriter, req rpcRequest, user User) {
+	var params struct {
+		StartDate json.RawMessage `json:"startDate"`
+		EndDate   json.RawMessage `json:"endDate"`
+	}
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		writeError(w, req.ID, codeInvalidParams, "invalid params")
+		return
+	}
+	start, err1 := parseDate(params.StartDate)
+	end, err2 := parseDate(params.EndDate)
+	if err1 != nil || err2 != nil || end.Before(start) || end.Sub(start) > maxTimetableDays*24*time.Hour {
+		writeError(w, req.ID, codeInvalidParams, "invalid date range")
+		return
+	}
+	writeResult(w, req.ID, s.timetable(user, start, end))
+}
+
+// timetable returns the lessons of the user's class from start to end with
+// the scripted changes that are due applied
+func (s *Server) timetable(user User, start, end time.Time) []entry {
+	now := s.now()
+	s.mutex.Lock()
+	due := make([]Change, 0, len(s.fixtures.Changes))
+	for _, c := range s.fixtures.Changes {
+		if now.Sub(s.started) >= time.Duration(c.After) {
+			due = append(due, c)
+		}
+	}
+	s.mutex.Unlock()
+
+	lessons := append([]Lesson(nil), s.fixtures.Lessons...)
+	for _, c := range due {
+		if c.Add != nil {
+			lessons = append(lessons, *c.Add)
+		}
+	}
+
+	entries := []entry{}
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		if s.holiday(day) {
+			continue
+		}
+	lessons:
+		for _, l := range lessons {
+			if !l.on(day, now) || (user.KlasseID != 0 && len(l.Kl) > 0 && !contains(l.Kl, user.KlasseID)) {
+				continue
+			}
+			for _, c := range due {
+				if c.Add != nil || c.Lesson != l.ID || (c.Date != "" && !sameDay(c.Date, day, now)) {
+					continue
+				}
+				if c.Remove {
+					continue lessons
+				}
+				l = c.apply(l)
+			}
+			entries = append(entries, l.entry(day))
+		}
+	}
+	return entries
+}
+
+func (s *Server) holiday(day time.Time) bool {
+	date := dateInt(day)
+	for _, h := range s.fixtures.Holidays {
+		if date >= h.StartDate && date <= h.EndDate {
+			return true
+		}
+	}
+	return false
+}
+
+// on reports whether the lesson takes place on day
+func (l Lesson) on(day, now time.Time) bool {
+	if l.Date != "" {
+		return sameDay(l.Date, day, now)
+	}
+	weekday := int(day.Weekday())
+	if weekday == 0 {
+		weekday = 7
+	}
+	return contains(l.Weekdays, weekday)
+}
+
+func (l Lesson) entry(day time.Time) entry {
+	activity := l.ActivityType
+	if activity == "" {
+		activity = "Unterricht"
+	}
+	date := dateInt(day)
+	return entry{
+		// every occurrence of a lesson has its own id, like in the real timetable
+		ID:        l.ID*1000000 + date%1000000,
+		Date:      date,
+		StartTime: l.StartTime,
+		EndTime:   l.EndTime,
+		Code:      l.Code,
+		Kl:        ids(l.Kl), Te: ids(l.Te), Su: ids(l.Su), Ro: ids(l.Ro),
+		ActivityType: activity,
+	}
+}
+
+func (c Change) apply(l Lesson) Lesson {
+	switch c.Code {
+	case "":
+	case "regular":
+		l.Code = ""
+	default:
+		l.Code = c.Code
+	}
+	if c.StartTime != 0 {
+		l.StartTime = c.StartTime
+	}
+	if c.EndTime != 0 {
+		l.EndTime = c.EndTime
+	}
+	if c.Su != nil {
+		l.Su = c.Su
+	}
+	if c.Ro != nil {
+		l.Ro = c.Ro
+	}
+	if c.Te != nil {
+		l.Te = c.Te
+	}
+	return l
+}
+
+// sameDay reports whether day is the date, which is like 2025-09-01 or
+// today or tomorrow seen from now
+func sameDay(date string, day, now time.Time) bool {
+	switch date {
+	case "today":
+		return dateInt(day) == dateInt(now)
+	case "tomorrow":
+		return dateInt(day) == dateInt(now.AddDate(0, 0, 1))
+	}
+	return day.Format("2006-01-02") == date
+}
+
+// parseDate reads a date like 20250901, as a number or a string
+func parseDate(raw json.RawMessage) (time.Time, error) {
+	return time.ParseInLocation("20060102", strings.Trim(string(raw), `"`), time.Local)
+}
+
+func dateInt(t time.Time) int {
+	n, _ := strconv.Atoi(t.Format("20060102"))
+	return n
+}
+
+func ids(list []int) []idObj {
+	out := make([]idObj, len(list))
+	for i, id := range list {
+		out[i] = idObj{id}
+	}
+	return out
+}
+
+func contains(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func writeResult(w http.ResponseWriter, id string, result interface{}) {
+	writeJSON(w, map[string]interface{}{"jsonrpc": "2.0", "id": id, "result": result})
+}
+
+func writeError(w http.ResponseWriter, id string, code int, message string) {
+	writeJSON(w, map[string]interface{}{"jsonrpc": "2.0", "id": id, "error": rpcError{code, message}})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// totp is the one time password of a base32 secret at t, like the Untis app
+// makes it (RFC 6238, SHA-1, 6 digits, 30 seconds)
+func totp(secret string, t time.Time) (int, bool) {
+	secret = strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "="))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return 0, false
+	}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return int(code % 1000000), true
+}
@@ -0,0 +1,181 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	Clock "untislogger/Clock"
+	Config "untislogger/Config"
+	Logging "untislogger/Logging"
+	Metrics "untislogger/Metrics"
+	Status "untislogger/Status"
+	Store "untislogger/Store"
+)
+
+// Sender delivers the content of a message to target, it gives up when ctx is done
+type Sender func(ctx context.Context, target, content string) error
+
+// How often failed messages are retried and how often before they are dropped
+const (
+	retryInterval = 30 * time.Second
+	maxAttempts   = 20
+)
+
+var logger = Logging.For("notify")
+
+var (
+	senders   = make(map[string]Sender)
+	sendMutex sync.Mutex // one delivery run at a time
+	db        Store.Store
+	quiet     Config.QuietHours // no messages are delivered in these hours
+	wake      = make(chan struct{}, 1)
+
+	dryRun      io.Writer // set by DryRun, messages are written there instead of being sent
+	dryRunMutex sync.Mutex
+
+	clock = Clock.Real // set by SetClock
+)
+
+// SetClock sets the clock of the quiet hours, the retries and the dry run
+// output, call it before Start
+func SetClock(c Clock.Clock) {
+	clock = c
+}
+
+// DryRun writes every message to w instead of sending it, whatever notifier
+// it is for. The outbox is left alone, messages queued before are neither
+// sent nor removed.
+func DryRun(w io.Writer) {
+	dryRunMutex.Lock()
+	defer dryRunMutex.Unlock()
+	dryRun = w
+}
+
+// Print writes a message to the output set by DryRun and reports whether it
+// did, without DryRun it does nothing
+func Print(kind, target, content string) bool {
+	dryRunMutex.Lock()
+	defer dryRunMutex.Unlock()
+	if dryRun == nil {
+		return false
+	}
+	to := kind
+	if target != "" {
+		to += " " + target
+	}
+	if _, err := fmt.Fprintf(dryRun, "%s [dry run] %s: %s\n", clock.Now().Format(time.RFC3339), to, content); err != nil {
+		logger.Error("Error printing notification", "notifier", kind, "err", err)
+	}
+	Metrics.Notifications.Inc(kind, "dry_run")
+	return true
+}
+
+// Register sets the sender used for messages of the given kind
+func Register(kind string, send Sender) {
+	sendMutex.Lock()
+	defer sendMutex.Unlock()
+	senders[kind] = send
+}
+
+// Start delivers the messages in the outbox of st, right away when they are
+// sent and again every retryInterval for the ones that failed, until ctx is
+// done. Messages sent in the quiet hours wait in the outbox until they are over.
+func Start(ctx context.Context, st Store.Store, quietHours Config.QuietHours) {
+	db = st
+	quiet = quietHours
+	retry := clock
+	go func() {
+		for {
+			deliver(ctx)
+			select {
+			case <-retry.After(retryInterval):
+			case <-wake:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Drain tries once more to deliver the messages in the outbox before
+// shutting down, until ctx is done. What is left is sent after the restart.
+func Drain(ctx context.Context) {
+	if db == nil {
+		return
+	}
+	deliver(ctx)
+}
+
+// Send puts a message into the outbox, it survives restarts until it was delivered
+func Send(kind, target, content string) {
+	if Print(kind, target, content) {
+		return
+	}
+	if db == nil {
+		logger.Warn("Dropping notification, the outbox is not started", "notifier", kind)
+		return
+	}
+	_, err := db.Enqueue(Store.Message{Kind: kind, Target: target, Content: content, Created: clock.Now()})
+	if err != nil {
+		logger.Error("Error queueing notification", "notifier", kind, "err", err)
+		return
+	}
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver tries to send every message in the outbox once
+func deliver(ctx context.Context) {
+	sendMutex.Lock()
+	defer sendMutex.Unlock()
+	dryRunMutex.Lock()
+	dry := dryRun != nil
+	dryRunMutex.Unlock()
+	if dry || quiet.InQuietHours(clock.Now()) {
+		return
+	}
+	messages, err := db.Outbox()
+	if err != nil {
+		logger.Error("Error reading outbox", "err", err)
+		return
+	}
+	for _, msg := range messages {
+		if ctx.Err() != nil {
+			return
+		}
+		send, ok := senders[msg.Kind]
+		if !ok {
+			err = fmt.Errorf("no sender for %q", msg.Kind)
+		} else {
+			err = send(ctx, msg.Target, msg.Content)
+		}
+		if ctx.Err() != nil {
+			return // interrupted by the shutdown, not a failed attempt
+		}
+		Status.RecordNotification(msg.Kind, err)
+		if err == nil {
+			Metrics.Notifications.Inc(msg.Kind, "sent")
+			if err := db.DeleteMessage(msg.ID); err != nil {
+				logger.Error("Error removing delivered message", "notifier", msg.Kind, "err", err)
+			}
+			continue
+		}
+		Metrics.Notifications.Inc(msg.Kind, "failed")
+		logger.Warn("Sending notification failed", "notifier", msg.Kind, "attempt", msg.Attempts+1, "err", err)
+		msg.Attempts++
+		msg.LastError = err.Error()
+		if msg.Attempts >= maxAttempts {
+			Metrics.Notifications.Inc(msg.Kind, "dropped")
+			logger.Error("Dropping notification", "notifier", msg.Kind, "attempts", msg.Attempts, "err", err)
+			db.DeleteMessage(msg.ID)
+			continue
+		}
+		if err := db.UpdateMessage(msg); err != nil {
+			logger.Error("Error updating outbox", "err", err)
+		}
+	}
+}
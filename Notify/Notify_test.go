@@ -0,0 +1,70 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+	Config "untislogger/Config"
+	Store "untislogger/Store"
+)
+
+func TestDryRun(t *testing.T) {
+	st, err := Store.Open("json", "", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	// a message queued before the dry run must survive it
+	if _, err := st.Enqueue(Store.Message{Kind: "webhook", Content: "queued before", Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan string, 10)
+	Register("webhook", func(ctx context.Context, target, content string) error {
+		sent <- content
+		return nil
+	})
+	var out bytes.Buffer
+	DryRun(&out)
+	defer DryRun(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	Start(ctx, st, Config.QuietHours{})
+
+	Send("webhook", "", "lesson cancelled")
+	Send("dm", "42", "**anna**: room changed")
+	Send("new-backend", "x", "works for every notifier")
+	Drain(ctx)
+
+	printed := out.String()
+	for _, want := range []string{"[dry run] webhook: lesson cancelled", "[dry run] dm 42: **anna**: room changed", "[dry run] new-backend x: works for every notifier"} {
+		if !strings.Contains(printed, want) {
+			t.Errorf("dry run output %q does not contain %q", printed, want)
+		}
+	}
+	select {
+	case content := <-sent:
+		t.Errorf("%q was sent in the dry run", content)
+	case <-time.After(50 * time.Millisecond):
+	}
+	messages, err := st.Outbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Content != "queued before" {
+		t.Errorf("outbox after the dry run = %+v, want only the message queued before", messages)
+	}
+
+	// without the dry run the queued message goes out again
+	DryRun(nil)
+	Drain(ctx)
+	select {
+	case content := <-sent:
+		if content != "queued before" {
+			t.Errorf("sent %q", content)
+		}
+	case <-time.After(time.Second):
+		t.Error("the queued message was not sent after the dry run")
+	}
+}
@@ -0,0 +1,176 @@
+package pool
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+	Metrics "untislogger/Metrics"
+	Status "untislogger/Status"
+)
+
+// Job is one piece of work, usually fetching the timetable of one account
+type Job struct {
+	Key    string // at most one job per key is queued or running
+	Server string // jobs of the same server share the per server limit
+	Run    func()
+}
+
+// queued is a job whose delay is over, waiting for a worker
+type queued struct {
+	Job
+	since time.Time
+}
+
+// Pool runs jobs on a fixed number of workers. Every job is started after a
+// delay that is the same for its key on every run, so the fetches of many
+// accounts are spread out instead of all hitting Untis at once.
+type Pool struct {
+	perServer int
+	jitter    time.Duration
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	queue   []queued
+	pending map[string]bool          // keys waiting, queued or running
+	servers map[string]chan struct{} // free slots per server
+	running int
+	stopped bool
+}
+
+// New starts a pool with the given number of workers, at most perServer of
+// them talk to the same server at a time. Jobs are delayed by up to jitter.
+func New(workers, perServer int, jitter time.Duration) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	if perServer < 1 {
+		perServer = workers
+	}
+	p := &Pool{
+		perServer: perServer,
+		jitter:    jitter,
+		pending:   make(map[string]bool),
+		servers:   make(map[string]chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mutex)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues a job, it returns false and drops the job when the previous
+// job with the same key did not finish yet or the pool was stopped.
+func (p *Pool) Submit(job Job) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stopped {
+		return false
+	}
+	if p.pending[job.Key] {
+		Status.RecordSkip()
+		return false
+	}
+	p.pending[job.Key] = true
+	p.report()
+	time.AfterFunc(p.delay(job.Key), func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if p.stopped {
+			delete(p.pending, job.Key)
+			return
+		}
+		p.queue = append(p.queue, queued{job, time.Now()})
+		p.report()
+		p.cond.Signal()
+	})
+	return true
+}
+
+// delay returns the start offset of a key, the same one on every run
+func (p *Pool) delay(key string) time.Duration {
+	if p.jitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return time.Duration(h.Sum64() % uint64(p.jitter))
+}
+
+func (p *Pool) work() {
+	for {
+		p.mutex.Lock()
+		for len(p.queue) == 0 && !p.stopped {
+			p.cond.Wait()
+		}
+		if p.stopped {
+			p.mutex.Unlock()
+			return
+		}
+		next := p.queue[0]
+		p.queue = p.queue[1:]
+		job := next.Job
+		Metrics.SchedulerLag.ObserveDuration(time.Since(next.since), "pool")
+		p.running++
+		p.report()
+		slots := p.slots(job.Server)
+		p.mutex.Unlock()
+
+		slots <- struct{}{}
+		job.Run()
+		<-slots
+
+		p.mutex.Lock()
+		p.running--
+		delete(p.pending, job.Key)
+		p.report()
+		p.cond.Broadcast() // wakes Stop
+		p.mutex.Unlock()
+	}
+}
+
+// Stop drops the jobs that did not start yet and waits until the running ones
+// are finished or ctx is done. No jobs are accepted afterwards.
+func (p *Pool) Stop(ctx context.Context) error {
+	p.mutex.Lock()
+	p.stopped = true
+	for _, job := range p.queue {
+		delete(p.pending, job.Key)
+	}
+	p.queue = nil
+	p.report()
+	p.cond.Broadcast()
+	p.mutex.Unlock()
+
+	idle := make(chan struct{})
+	go func() {
+		p.mutex.Lock()
+		for p.running > 0 {
+			p.cond.Wait()
+		}
+		p.mutex.Unlock()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// slots returns the semaphore of a server, p.mutex has to be held
+func (p *Pool) slots(server string) chan struct{} {
+	s, ok := p.servers[server]
+	if !ok {
+		s = make(chan struct{}, p.perServer)
+		p.servers[server] = s
+	}
+	return s
+}
+
+// report publishes the queue depth, p.mutex has to be held
+func (p *Pool) report() {
+	Status.RecordQueue(len(p.pending)-p.running, p.running)
+}
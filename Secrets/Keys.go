@@ -0,0 +1,201 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	Config "untislogger/Config"
+	fileutil "untislogger/Fileutil"
+	Logging "untislogger/Logging"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ID of the key derived from the passphrase
+const PassphraseKeyID = "passphrase"
+
+// Load builds the keyring from the encryption config. A key derived from a
+// passphrase comes first and encrypts, the keys from keys, key, key_file or
+// the systemd credential enc_key follow. The salt of the passphrase is kept
+// in dataDir/kdf.json, whether the old formats are rejected in
+// dataDir/migrated.json.
+func Load(enc Config.Encryption, dataDir string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string][]byte), migratedFile: filepath.Join(dataDir, "migrated.json")}
+
+	passphrase, err := secret(enc.Passphrase, enc.PassphraseFile, enc.CredentialsDir, "enc_passphrase")
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		key, err := derive(passphrase, enc.KDF, filepath.Join(dataDir, "kdf.json"))
+		if err != nil {
+			return nil, err
+		}
+		if err := k.Add(PassphraseKeyID, key); err != nil {
+			return nil, err
+		}
+	}
+
+	list := enc.Keys
+	if list == "" {
+		key, err := secret(enc.Key, enc.KeyFile, enc.CredentialsDir, "enc_key")
+		if err != nil {
+			return nil, err
+		}
+		list = key
+		if key != "" && !strings.Contains(key, ":") {
+			list = DefaultKeyID + ":" + key
+		}
+	}
+	if list != "" {
+		keys, err := ParseKeys(list)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range keys.ids {
+			if err := k.Add(id, keys.keys[id]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(k.ids) == 0 {
+		return nil, ErrNoKeys
+	}
+	return k, nil
+}
+
+// isMigrated reports whether setMigrated was called, also by an earlier run
+func (k *Keyring) isMigrated() (bool, error) {
+	if k.migrated.Load() || k.migratedFile == "" {
+		return k.migrated.Load(), nil
+	}
+	_, err := os.Stat(k.migratedFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// setMigrated records that no stored secret is in an old format anymore. It
+// is kept in a file and not in the store, so removing it from the store does
+// not let the old formats in again.
+func (k *Keyring) setMigrated() error {
+	k.migrated.Store(true)
+	if k.migratedFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(map[string]time.Time{"migrated": time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteFile(k.migratedFile, data, 0600)
+}
+
+// secret returns value, or reads the file or the systemd credential in
+// credentialsDir, in that order. Empty if none of them is set.
+func secret(value, file, credentialsDir, credential string) (string, error) {
+	if value != "" {
+		Logging.AddSecret(value)
+		return value, nil
+	}
+	if file == "" && credentialsDir != "" {
+		file = filepath.Join(credentialsDir, credential)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			return "", nil
+		}
+	}
+	if file == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", credential, err)
+	}
+	value = strings.TrimRight(string(data), "\r\n")
+	Logging.AddSecret(value)
+	return value, nil
+}
+
+// kdfParams are the settings a passphrase was turned into a key with. They
+// are saved on first use, so later changes to the defaults do not change keys.
+type kdfParams struct {
+	KDF  string `json:"kdf"` // argon2id or scrypt
+	Salt string `json:"salt"`
+
+	Time    uint32 `json:"time,omitempty"`    // argon2id
+	Memory  uint32 `json:"memory,omitempty"`  // argon2id, in KiB
+	Threads uint8  `json:"threads,omitempty"` // argon2id
+	N       int    `json:"n,omitempty"`       // scrypt
+	R       int    `json:"r,omitempty"`       // scrypt
+	P       int    `json:"p,omitempty"`       // scrypt
+}
+
+// derive turns the passphrase into a key with kdf (argon2id or scrypt), the
+// salt and parameters are read from or created in path.
+func derive(passphrase, kdf, path string) ([]byte, error) {
+	var params kdfParams
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &params); err != nil {
+			return nil, fmt.Errorf("%s is corrupt: %w", path, err)
+		}
+		if params.KDF != kdf {
+			return nil, fmt.Errorf("%s was created for %s, but encryption.kdf is %s", path, params.KDF, kdf)
+		}
+	case os.IsNotExist(err):
+		if params, err = newParams(kdf); err != nil {
+			return nil, err
+		}
+		data, err := json.MarshalIndent(params, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := fileutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(params.Salt)
+	if err != nil || len(salt) < 16 {
+		return nil, fmt.Errorf("%s has an invalid salt", path)
+	}
+	switch params.KDF {
+	case "argon2id":
+		return argon2.IDKey([]byte(passphrase), salt, params.Time, params.Memory, params.Threads, 32), nil
+	case "scrypt":
+		return scrypt.Key([]byte(passphrase), salt, params.N, params.R, params.P, 32)
+	}
+	return nil, fmt.Errorf("unknown kdf %q, use argon2id or scrypt", params.KDF)
+}
+
+func newParams(kdf string) (kdfParams, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return kdfParams{}, err
+	}
+	params := kdfParams{KDF: kdf, Salt: base64.StdEncoding.EncodeToString(salt)}
+	switch kdf {
+	case "argon2id":
+		params.Time, params.Memory, params.Threads = 3, 64*1024, 4
+	case "scrypt":
+		params.N, params.R, params.P = 1<<15, 8, 1
+	default:
+		return kdfParams{}, errors.New("unknown kdf " + kdf + ", use argon2id or scrypt")
+	}
+	return params, nil
+}
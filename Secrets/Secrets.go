@@ -0,0 +1,311 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	Logging "untislogger/Logging"
+	Store "untislogger/Store"
+)
+
+// ErrNoKeys is returned by Load when no key is configured
+var ErrNoKeys = errors.New("no encryption key configured, set encryption.key or encryption.passphrase (ENC_KEY, ENC_KEYS, ENC_KEY_FILE or ENC_PASSPHRASE)")
+
+// ErrLegacy is returned by Decrypt for the formats without associated data
+// once all stored secrets were upgraded
+var ErrLegacy = errors.New("secret is in an old format that is not accepted anymore, set encryption.allow_legacy (ENC_ALLOW_LEGACY) to read it")
+
+// ID of the key given with ENC_KEY
+const DefaultKeyID = "default"
+
+// Ciphertexts look like v2:<key id>:<base64 of nonce and sealed text> and are
+// bound to associated data, usually the account they belong to. v1 had no
+// associated data, even older ones are only the base64 part and were
+// encrypted with ENC_KEY.
+const (
+	version1 = "v1"
+	version2 = "v2"
+)
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Keyring holds the keys secrets are encrypted with. The first key encrypts,
+// all of them decrypt, so an old key can stay configured until Rotate
+// re-encrypted everything with the new one.
+type Keyring struct {
+	ids  []string
+	keys map[string][]byte
+
+	allowLegacy  bool        // set by AllowLegacy
+	legacy       atomic.Bool // the store still has secrets in the old formats, set by CheckLegacy
+	migrated     atomic.Bool // no secret was in an old format anymore, from then on they are rejected
+	migratedFile string      // where migrated is kept across restarts, set by Load
+}
+
+// ParseKeys parses a comma separated list of <id>:<base64 key>, every key has
+// to be 32 bytes long
+func ParseKeys(list string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string][]byte)}
+	for _, item := range strings.Split(list, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if !ok || !keyIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("encryption keys must look like <id>:<base64 key>, got %q", redact(item))
+		}
+		Logging.AddSecret(encoded)
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s is not valid base64", id)
+		}
+		if err := k.Add(id, key); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Add adds a key, the first key added is the one used for encrypting
+func (k *Keyring) Add(id string, key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("encryption key %s must be exactly 32 bytes after base64 decoding", id)
+	}
+	if _, ok := k.keys[id]; ok {
+		return fmt.Errorf("encryption key %s is configured twice", id)
+	}
+	k.ids = append(k.ids, id)
+	k.keys[id] = key
+	return nil
+}
+
+// redact hides the key of a malformed list item in error messages
+func redact(item string) string {
+	if len(item) > 4 {
+		return item[:4] + "..."
+	}
+	return item
+}
+
+// Primary returns the ID of the key used for encrypting
+func (k *Keyring) Primary() string {
+	return k.ids[0]
+}
+
+func gcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AccountData is the associated data binding a password to its account, so
+// it can not be copied to another account
+func AccountData(userID, username string) []byte {
+	return []byte(fmt.Sprintf("untislogger account %d:%s %d:%s", len(userID), userID, len(username), username))
+}
+
+// Encrypt encrypts text with the primary key, it can only be decrypted again
+// with the same associated data
+func (k *Keyring) Encrypt(text string, data []byte) (string, error) {
+	aesGCM, err := gcm(k.keys[k.Primary()])
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aesGCM.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	ciphertext := aesGCM.Seal(nonce, nonce, []byte(text), data)
+	return version2 + ":" + k.Primary() + ":" + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// AllowLegacy decrypts the old formats even after all stored secrets were
+// upgraded, e.g. to restore an old backup. Call it before using the keyring.
+func (k *Keyring) AllowLegacy(allow bool) {
+	k.allowLegacy = allow
+}
+
+// legacy reports whether a secret is in one of the formats without
+// associated data
+func legacy(encrypted string) bool {
+	return encrypted != "" && !strings.HasPrefix(encrypted, version2+":")
+}
+
+// CheckLegacy lets Decrypt accept the old formats as long as accounts in st
+// still use them. Once none does, that is recorded next to the keys, outside
+// the store, and from then on a secret in an old format copied into the store
+// is rejected for good.
+func (k *Keyring) CheckLegacy(st Store.Store) error {
+	if done, err := k.isMigrated(); err != nil || done {
+		k.legacy.Store(false)
+		return err
+	}
+	accounts, err := st.Accounts()
+	if err != nil {
+		return err
+	}
+	for _, acc := range accounts {
+		if legacy(acc.Password) || legacy(acc.Secret) {
+			k.legacy.Store(true)
+			return nil
+		}
+	}
+	k.legacy.Store(false)
+	return k.setMigrated()
+}
+
+// Decrypt decrypts a secret encrypted by Encrypt or, while CheckLegacy or
+// AllowLegacy allow it, by older versions of the bot. data is ignored for the
+// older versions, which had no associated data.
+func (k *Keyring) Decrypt(encrypted string, data []byte) (string, error) {
+	if legacy(encrypted) && !k.allowLegacy && !k.legacy.Load() {
+		return "", ErrLegacy
+	}
+	for _, version := range []string{version2, version1} {
+		rest, ok := strings.CutPrefix(encrypted, version+":")
+		if !ok {
+			continue
+		}
+		id, sealed, _ := strings.Cut(rest, ":")
+		key, ok := k.keys[id]
+		if !ok {
+			return "", fmt.Errorf("encrypted with key %q, which is not configured", id)
+		}
+		if version == version1 {
+			return open(key, sealed, nil)
+		}
+		return open(key, sealed, data)
+	}
+	// without a version it was encrypted with ENC_KEY, which may since have
+	// been given another ID
+	var err error
+	for _, id := range k.ids {
+		var text string
+		if text, err = open(k.keys[id], encrypted, nil); err == nil {
+			return text, nil
+		}
+	}
+	return "", err
+}
+
+func open(key []byte, encoded string, additional []byte) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	aesGCM, err := gcm(key)
+	if err != nil {
+		return "", err
+	}
+	nonceSize := aesGCM.NonceSize()
+	if len(data) < nonceSize {
+		return "", errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Current reports whether a secret is already encrypted with the primary key
+// and the current format
+func (k *Keyring) Current(encrypted string) bool {
+	return strings.HasPrefix(encrypted, version2+":"+k.Primary()+":")
+}
+
+// CurrentAccount reports whether the password and app secret of an account
+// are encrypted with the primary key and the current format
+func (k *Keyring) CurrentAccount(acc Store.Account) bool {
+	return (acc.Password == "" || k.Current(acc.Password)) && (acc.Secret == "" || k.Current(acc.Secret))
+}
+
+// secretData is the associated data of the app secret of an account
+func secretData(acc Store.Account) []byte {
+	return append(AccountData(acc.UserID, acc.Username), " secret"...)
+}
+
+// Password decrypts the password of an account
+func (k *Keyring) Password(acc Store.Account) (string, error) {
+	return k.Decrypt(acc.Password, AccountData(acc.UserID, acc.Username))
+}
+
+// SetPassword encrypts password and stores it in acc
+func (k *Keyring) SetPassword(acc *Store.Account, password string) error {
+	encrypted, err := k.Encrypt(password, AccountData(acc.UserID, acc.Username))
+	if err != nil {
+		return err
+	}
+	acc.Password = encrypted
+	return nil
+}
+
+// Secret decrypts the app secret of an account
+func (k *Keyring) Secret(acc Store.Account) (string, error) {
+	return k.Decrypt(acc.Secret, secretData(acc))
+}
+
+// SetSecret encrypts the app secret and stores it in acc
+func (k *Keyring) SetSecret(acc *Store.Account, secret string) error {
+	encrypted, err := k.Encrypt(secret, secretData(*acc))
+	if err != nil {
+		return err
+	}
+	acc.Secret = encrypted
+	return nil
+}
+
+// Reencrypt encrypts the password and app secret of acc again with the
+// primary key and the current format
+func (k *Keyring) Reencrypt(acc *Store.Account) error {
+	if acc.Password != "" {
+		password, err := k.Password(*acc)
+		if err != nil {
+			return fmt.Errorf("password of %s: %w", acc.UserID, err)
+		}
+		if err := k.SetPassword(acc, password); err != nil {
+			return err
+		}
+	}
+	if acc.Secret != "" {
+		secret, err := k.Secret(*acc)
+		if err != nil {
+			return fmt.Errorf("secret of %s: %w", acc.UserID, err)
+		}
+		if err := k.SetSecret(acc, secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rotate re-encrypts the passwords and secrets of all accounts in st that are
+// not encrypted with the primary key and the current format yet and returns
+// how many accounts were changed. Either all accounts are saved or, if one
+// can not be decrypted, none. Afterwards the old formats are rejected.
+func (k *Keyring) Rotate(st Store.Store) (int, error) {
+	changed := 0
+	err := st.UpdateAccounts(func(accounts []Store.Account) error {
+		for i := range accounts {
+			if k.CurrentAccount(accounts[i]) {
+				continue
+			}
+			if err := k.Reencrypt(&accounts[i]); err != nil {
+				return err
+			}
+			changed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return changed, k.CheckLegacy(st)
+}
@@ -0,0 +1,203 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+	Store "untislogger/Store"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	k, err := ParseKeys("new:" + testKey(1) + ",old:" + testKey(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := AccountData("42", "anna")
+	tests := []string{"", "password", "pässwört with spaces and ünicode", strings.Repeat("x", 1000)}
+	for _, text := range tests {
+		encrypted, err := k.Encrypt(text, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(encrypted, "v2:new:") {
+			t.Errorf("Encrypt(%q) = %q, want it encrypted with the primary key", text, encrypted)
+		}
+		if text != "" && strings.Contains(encrypted, text) {
+			t.Errorf("Encrypt(%q) contains the text", text)
+		}
+		got, err := k.Decrypt(encrypted, data)
+		if err != nil || got != text {
+			t.Errorf("Decrypt(Encrypt(%q)) = %q, %v", text, got, err)
+		}
+	}
+
+	a, _ := k.Encrypt("password", data)
+	b, _ := k.Encrypt("password", data)
+	if a == b {
+		t.Error("Encrypt() returned the same ciphertext twice")
+	}
+}
+
+func TestDecryptFails(t *testing.T) {
+	k, err := ParseKeys("a:" + testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ParseKeys("b:" + testKey(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKey, err := ParseKeys("a:" + testKey(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := k.Encrypt("password", AccountData("42", "anna"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		k         *Keyring
+		encrypted string
+		data      []byte
+	}{
+		{"other account", k, encrypted, AccountData("43", "anna")},
+		{"other username", k, encrypted, AccountData("42", "ben")},
+		{"key not configured", other, encrypted, AccountData("42", "anna")},
+		{"wrong key with the same id", wrongKey, encrypted, AccountData("42", "anna")},
+		{"tampered", k, encrypted[:len(encrypted)-4] + "AAA=", AccountData("42", "anna")},
+		{"not base64", k, "v2:a:***", AccountData("42", "anna")},
+		{"too short", k, "v2:a:AAAA", AccountData("42", "anna")},
+	}
+	for _, tt := range tests {
+		if got, err := tt.k.Decrypt(tt.encrypted, tt.data); err == nil {
+			t.Errorf("%s: Decrypt() = %q, want an error", tt.name, got)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		wantErr bool
+	}{
+		{"one key", "a:" + testKey(1), false},
+		{"two keys", "a:" + testKey(1) + ", b:" + testKey(2), false},
+		{"no id", testKey(1), true},
+		{"bad id", "a b:" + testKey(1), true},
+		{"not base64", "a:not base64!", true},
+		{"too short", "a:" + base64.StdEncoding.EncodeToString([]byte("short")), true},
+		{"twice", "a:" + testKey(1) + ",a:" + testKey(2), true},
+	}
+	for _, tt := range tests {
+		k, err := ParseKeys(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ParseKeys() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil && strings.Contains(err.Error(), testKey(1)) {
+			t.Errorf("%s: ParseKeys() error contains the key", tt.name)
+		}
+		if err == nil && k.Primary() != "a" {
+			t.Errorf("%s: Primary() = %q, want a", tt.name, k.Primary())
+		}
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	oldKeys, _ := ParseKeys("old:" + testKey(1))
+	k, _ := ParseKeys("new:" + testKey(2) + ",old:" + testKey(1))
+
+	acc := Store.Account{UserID: "42", Username: "anna"}
+	if err := oldKeys.SetPassword(&acc, "password"); err != nil {
+		t.Fatal(err)
+	}
+	if k.CurrentAccount(acc) {
+		t.Error("CurrentAccount() of a password encrypted with the old key = true")
+	}
+	if err := k.Reencrypt(&acc); err != nil {
+		t.Fatal(err)
+	}
+	if !k.CurrentAccount(acc) {
+		t.Error("CurrentAccount() after Reencrypt = false")
+	}
+	if got, err := k.Password(acc); err != nil || got != "password" {
+		t.Errorf("Password() = %q, %v, want password", got, err)
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	migratedFile := filepath.Join(t.TempDir(), "migrated.json")
+	k, _ := ParseKeys("default:" + testKey(1))
+	k.migratedFile = migratedFile
+	st, err := Store.Open("json", "", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	// v1 was the current format without associated data
+	encrypted, err := k.Encrypt("password", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := "v1:" + strings.TrimPrefix(encrypted, "v2:")
+	unversioned := strings.TrimPrefix(encrypted, "v2:default:")
+
+	// old passwords in the store are read until they were upgraded
+	if err := st.SaveAccount(Store.Account{UserID: "42", Username: "anna", Password: v1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.CheckLegacy(st); err != nil {
+		t.Fatal(err)
+	}
+	for _, old := range []string{v1, unversioned} {
+		if got, err := k.Decrypt(old, AccountData("43", "ben")); err != nil || got != "password" {
+			t.Errorf("Decrypt(%q) before the upgrade = %q, %v", old, got, err)
+		}
+	}
+	if n, err := k.Rotate(st); err != nil || n != 1 {
+		t.Fatalf("Rotate() = %d, %v", n, err)
+	}
+
+	// afterwards a copied old password is rejected, also after a restart and
+	// with old passwords put back into the store
+	restarted, _ := ParseKeys("default:" + testKey(1))
+	restarted.migratedFile = migratedFile
+	if err := st.SaveAccount(Store.Account{UserID: "43", Username: "ben", Password: v1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []*Keyring{k, restarted} {
+		if err := k.CheckLegacy(st); err != nil {
+			t.Fatal(err)
+		}
+		for _, old := range []string{v1, unversioned} {
+			if got, err := k.Decrypt(old, AccountData("43", "ben")); err != ErrLegacy {
+				t.Errorf("Decrypt(%q) after the upgrade = %q, %v, want ErrLegacy", old, got, err)
+			}
+		}
+	}
+	restarted.AllowLegacy(true)
+	if got, err := restarted.Decrypt(v1, nil); err != nil || got != "password" {
+		t.Errorf("Decrypt() with AllowLegacy = %q, %v", got, err)
+	}
+
+	// a new store has nothing to upgrade
+	fresh, err := Store.Open("json", "", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	k, _ = ParseKeys("default:" + testKey(1))
+	if err := k.CheckLegacy(fresh); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Decrypt(v1, nil); err != ErrLegacy {
+		t.Errorf("Decrypt() of a v1 password with a new store = %v, want ErrLegacy", err)
+	}
+}
@@ -0,0 +1,220 @@
+package status
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	Clock "untislogger/Clock"
+	Logging "untislogger/Logging"
+	Metrics "untislogger/Metrics"
+)
+
+// Fetch is the state of the Untis fetches of one account
+type Fetch struct {
+	Account      string        `json:"account"`
+	LastSuccess  time.Time     `json:"lastSuccess"`
+	LastAttempt  time.Time     `json:"lastAttempt"`
+	LastError    string        `json:"lastError,omitempty"`
+	Failing      bool          `json:"failing"`
+	FailingSince time.Time     `json:"failingSince,omitempty"` // the first failed attempt after the last success
+	Took         time.Duration `json:"took"`                   // how long the last fetch took
+}
+
+// Notifier is the state of one way of sending notifications
+type Notifier struct {
+	Name      string    `json:"name"`
+	LastSent  time.Time `json:"lastSent"`
+	LastError string    `json:"lastError,omitempty"`
+	Failing   bool      `json:"failing"`
+	Sent      int       `json:"sent"`
+	Failed    int       `json:"failed"`
+}
+
+// Gateway is the state of the connection to Discord
+type Gateway struct {
+	Enabled   bool      `json:"enabled"` // false when no bot token is configured
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"` // when it last connected or disconnected
+}
+
+// Error is the last error of any fetch, notifier or the Discord connection
+type Error struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"` // e.g. fetch main or notifier dm
+	Message string    `json:"message"`
+}
+
+var clock = Clock.Real // set by SetClock, guarded by mutex
+
+// SetClock sets the clock of the fetch, notification and connection times,
+// so /healthz compares them with the same clock the fetches run on
+func SetClock(c Clock.Clock) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	clock = c
+}
+
+var (
+	mutex     sync.Mutex
+	fetches   = make(map[string]*Fetch)
+	notifiers = make(map[string]*Notifier)
+	queue     Queue
+	gateway   Gateway
+	lastError *Error
+)
+
+// Queue is the state of the pool fetching the timetables of the accounts
+type Queue struct {
+	Waiting int `json:"waiting"` // fetches submitted but not started yet
+	Running int `json:"running"`
+	Skipped int `json:"skipped"` // fetches dropped because the one before was still running
+}
+
+// RecordFetch stores the result of an Untis fetch for an account and how long
+// it took, err is nil on success
+func RecordFetch(account string, took time.Duration, err error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	f, ok := fetches[account]
+	if !ok {
+		f = &Fetch{Account: account}
+		fetches[account] = f
+	}
+	f.LastAttempt = clock.Now()
+	f.Took = took.Round(time.Millisecond)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	Metrics.Fetches.Inc(result)
+	Metrics.FetchDuration.ObserveDuration(took, result)
+	if err != nil {
+		if !f.Failing {
+			f.FailingSince = f.LastAttempt
+		}
+		f.LastError = Logging.Redact(err.Error())
+		f.Failing = true
+		recordError("fetch "+account, err)
+		return
+	}
+	f.LastSuccess = f.LastAttempt
+	f.Failing = false
+	f.FailingSince = time.Time{}
+}
+
+// RecordError stores an error that is not from a fetch or notifier
+func RecordError(source string, err error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	recordError(source, err)
+}
+
+// recordError keeps err as the last error, mutex has to be held
+func recordError(source string, err error) {
+	Metrics.Errors.Inc(strings.Fields(source)[0])
+	lastError = &Error{Time: clock.Now(), Source: source, Message: Logging.Redact(err.Error())} // it is shown on /healthz
+}
+
+// LastError returns the last error of anything, nil if there was none
+func LastError() *Error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if lastError == nil {
+		return nil
+	}
+	e := *lastError
+	return &e
+}
+
+// RecordGateway stores whether the bot is connected to Discord
+func RecordGateway(connected bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	gateway = Gateway{Enabled: true, Connected: connected, Since: clock.Now()}
+}
+
+// GatewayState returns the state of the connection to Discord
+func GatewayState() Gateway {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return gateway
+}
+
+// RecordQueue stores how many fetches are waiting and running
+func RecordQueue(waiting, running int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	queue.Waiting = waiting
+	queue.Running = running
+}
+
+// RecordSkip counts a fetch that was dropped because the one before was still running
+func RecordSkip() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	queue.Skipped++
+}
+
+// QueueState returns the state of the fetch queue
+func QueueState() Queue {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return queue
+}
+
+// RecordNotification stores the result of sending a notification, err is nil on success
+func RecordNotification(name string, err error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	n, ok := notifiers[name]
+	if !ok {
+		n = &Notifier{Name: name}
+		notifiers[name] = n
+	}
+	if err != nil {
+		n.LastError = Logging.Redact(err.Error())
+		n.Failing = true
+		n.Failed++
+		recordError("notifier "+name, err)
+		return
+	}
+	n.LastSent = clock.Now()
+	n.Failing = false
+	n.Sent++
+}
+
+// FetchOf returns the fetch state of an account
+func FetchOf(account string) (Fetch, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	f, ok := fetches[account]
+	if !ok {
+		return Fetch{Account: account}, false
+	}
+	return *f, true
+}
+
+// Fetches returns the fetch state of all accounts sorted by account
+func Fetches() []Fetch {
+	mutex.Lock()
+	defer mutex.Unlock()
+	list := make([]Fetch, 0, len(fetches))
+	for _, f := range fetches {
+		list = append(list, *f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Account < list[j].Account })
+	return list
+}
+
+// Notifiers returns the state of all notifiers sorted by name
+func Notifiers() []Notifier {
+	mutex.Lock()
+	defer mutex.Unlock()
+	list := make([]Notifier, 0, len(notifiers))
+	for _, n := range notifiers {
+		list = append(list, *n)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
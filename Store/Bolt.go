@@ -0,0 +1,433 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+	Untis "untislogger/Bot"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	metaBucket        = []byte("meta")
+	accountsBucket    = []byte("accounts")
+	masterDataBucket  = []byte("masterdata")
+	timetablesBucket  = []byte("timetables")
+	snapshotsBucket   = []byte("snapshots") // one nested bucket per account
+	preferencesBucket = []byte("preferences")
+	guildsBucket      = []byte("guilds")
+	outboxBucket      = []byte("outbox")
+)
+
+// BoltStore keeps the whole state in one bbolt database file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens the database file at path and migrates it to the current
+// schema. On the first start the JSON files next to the database are imported.
+func OpenBolt(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, ErrInUse // bolt locks the file itself
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &BoltStore{db: db}
+
+	var version int
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if v := meta.Get([]byte("version")); v != nil {
+			version = int(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	migrations := []migration{
+		{"create buckets", s.createBuckets},
+		{"import JSON files", func() error { return s.importJSON(filepath.Dir(path)) }},
+		{"add calendar feed tokens", func() error { return addFeedTokens(s) }},
+		{"create guilds bucket", s.createBuckets},
+	}
+	err = runMigrations(version, migrations, func(version int) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(metaBucket).Put([]byte("version"), itob(uint64(version)))
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func (s *BoltStore) createBuckets() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{accountsBucket, masterDataBucket, timetablesBucket, snapshotsBucket, preferencesBucket, guildsBucket, outboxBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// importJSON copies the state of a JSON store in dir, if there is one. The
+// JSON store is migrated to its current layout first.
+func (s *BoltStore) importJSON(dir string) error {
+	found := false
+	for _, name := range []string{"accounts.json", "timetableFilled.json", "accounts"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	src, err := OpenJSON(dir)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	guilds, err := src.guilds()
+	if err != nil {
+		return err
+	}
+	for _, g := range guilds {
+		if err := s.SaveGuild(g); err != nil {
+			return err
+		}
+	}
+	accounts, err := src.Accounts()
+	if err != nil {
+		return err
+	}
+	for _, acc := range accounts {
+		if err := s.SaveAccount(acc); err != nil {
+			return err
+		}
+		if prefs, err := src.Preferences(acc.UserID); err == nil {
+			if err := s.SavePreferences(acc.UserID, prefs); err != nil {
+				return err
+			}
+		}
+	}
+	for _, kind := range []string{"rooms", "classes", "subjects", "teachers"} {
+		if data, err := src.MasterData(kind); err == nil {
+			if err := s.SaveMasterData(kind, data); err != nil {
+				return err
+			}
+		}
+	}
+	ids := []string{MainAccount}
+	for _, acc := range accounts {
+		ids = append(ids, acc.UserID)
+	}
+	for _, id := range ids {
+		if entries, err := src.Timetable(id); err == nil {
+			if err := s.SaveTimetable(id, entries); err != nil {
+				return err
+			}
+		}
+		times, err := src.SnapshotTimes(id)
+		if err != nil {
+			return err
+		}
+		for _, taken := range times {
+			snap, err := src.Snapshot(id, taken)
+			if err != nil {
+				return err
+			}
+			if err := s.SaveSnapshot(snap); err != nil {
+				return err
+			}
+		}
+	}
+	messages, err := src.Outbox()
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if _, err := s.Enqueue(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) get(bucket []byte, key string, v interface{}) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+func (s *BoltStore) put(bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+func (s *BoltStore) Accounts() ([]Account, error) {
+	var accounts []Account
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(accountsBucket).ForEach(func(k, v []byte) error {
+			var acc Account
+			if err := json.Unmarshal(v, &acc); err != nil {
+				return err
+			}
+			accounts = append(accounts, acc)
+			return nil
+		})
+	})
+	return accounts, err
+}
+
+func (s *BoltStore) SaveAccount(acc Account) error {
+	return s.put(accountsBucket, acc.UserID, acc)
+}
+
+// RemoveAccount removes the account together with its timetable, snapshots
+// and preferences
+func (s *BoltStore) RemoveAccount(userID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(userID)
+		for _, name := range [][]byte{accountsBucket, timetablesBucket, preferencesBucket} {
+			if err := tx.Bucket(name).Delete(key); err != nil {
+				return err
+			}
+		}
+		err := tx.Bucket(snapshotsBucket).DeleteBucket(key)
+		if errors.Is(err, bolt.ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *BoltStore) UpdateAccounts(update func(accounts []Account) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(accountsBucket)
+		var accounts []Account
+		err := b.ForEach(func(k, v []byte) error {
+			var acc Account
+			if err := json.Unmarshal(v, &acc); err != nil {
+				return err
+			}
+			accounts = append(accounts, acc)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := update(accounts); err != nil {
+			return err
+		}
+		for _, acc := range accounts {
+			data, err := json.Marshal(acc)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(acc.UserID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) MasterData(kind string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(masterDataBucket).Get([]byte(kind))
+		if v == nil {
+			return ErrNotFound
+		}
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	return data, err
+}
+
+func (s *BoltStore) SaveMasterData(kind string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(masterDataBucket).Put([]byte(kind), data)
+	})
+}
+
+func (s *BoltStore) Timetable(account string) ([]Untis.NamedTimetableEntry, error) {
+	var entries []Untis.NamedTimetableEntry
+	err := s.get(timetablesBucket, account, &entries)
+	return entries, err
+}
+
+func (s *BoltStore) SaveTimetable(account string, entries []Untis.NamedTimetableEntry) error {
+	return s.put(timetablesBucket, account, entries)
+}
+
+func (s *BoltStore) SnapshotTimes(account string) ([]time.Time, error) {
+	var times []time.Time
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(snapshotsBucket).Bucket([]byte(account))
+		if b == nil {
+			return nil
+		}
+		// keys sort by time
+		return b.ForEach(func(k, v []byte) error {
+			taken, err := time.Parse(snapshotLayout, string(k))
+			if err != nil {
+				return nil
+			}
+			times = append(times, taken)
+			return nil
+		})
+	})
+	return times, err
+}
+
+func (s *BoltStore) Snapshot(account string, taken time.Time) (Snapshot, error) {
+	var snap Snapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(snapshotsBucket).Bucket([]byte(account))
+		if b == nil {
+			return ErrNotFound
+		}
+		data := b.Get([]byte(snapshotKey(taken)))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &snap)
+	})
+	return snap, err
+}
+
+func (s *BoltStore) SaveSnapshot(snap Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(snapshotsBucket).CreateBucketIfNotExists([]byte(snap.Account))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(snapshotKey(snap.Taken)), data)
+	})
+}
+
+func (s *BoltStore) DeleteSnapshot(account string, taken time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(snapshotsBucket).Bucket([]byte(account))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(snapshotKey(taken)))
+	})
+}
+
+func (s *BoltStore) Preferences(userID string) (Preferences, error) {
+	var prefs Preferences
+	err := s.get(preferencesBucket, userID, &prefs)
+	if errors.Is(err, ErrNotFound) {
+		return Preferences{}, nil
+	}
+	return prefs, err
+}
+
+func (s *BoltStore) SavePreferences(userID string, prefs Preferences) error {
+	return s.put(preferencesBucket, userID, prefs)
+}
+
+func (s *BoltStore) Guild(guildID string) (Guild, error) {
+	g := Guild{ID: guildID}
+	err := s.get(guildsBucket, guildID, &g)
+	if errors.Is(err, ErrNotFound) {
+		return g, nil
+	}
+	return g, err
+}
+
+func (s *BoltStore) SaveGuild(g Guild) error {
+	return s.put(guildsBucket, g.ID, g)
+}
+
+func (s *BoltStore) Enqueue(msg Message) (Message, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		msg.ID = id
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(id), data)
+	})
+	return msg, err
+}
+
+func (s *BoltStore) Outbox() ([]Message, error) {
+	var messages []Message
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(k, v []byte) error {
+			var msg Message
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return err
+			}
+			messages = append(messages, msg)
+			return nil
+		})
+	})
+	return messages, err
+}
+
+func (s *BoltStore) UpdateMessage(msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		if b.Get(itob(msg.ID)) == nil {
+			return ErrNotFound
+		}
+		return b.Put(itob(msg.ID), data)
+	})
+}
+
+func (s *BoltStore) DeleteMessage(id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).Delete(itob(id))
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
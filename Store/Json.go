@@ -0,0 +1,526 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	Untis "untislogger/Bot"
+	fileutil "untislogger/Fileutil"
+	Logging "untislogger/Logging"
+)
+
+// JSONStore keeps every part of the state in its own JSON file. Everything of
+// one account lives in accounts/<id>/ (timetable.json, preferences.json and
+// snapshots/), the Untis master data in masterdata/. Files are replaced
+// atomically and only readable by the owner.
+type JSONStore struct {
+	dir      string
+	mutex    sync.Mutex
+	backedUp map[string]bool // corrupt files that were already copied
+	lock     *os.File        // held until Close, see lockFile
+}
+
+// lockName is the file in the data directory that is locked while it is open
+const lockName = "untislogger.lock"
+
+// OpenJSON opens the JSON files in dir and migrates them to the current
+// schema. It fails with ErrInUse while another process has dir open.
+func OpenJSON(dir string) (_ *JSONStore, err error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(filepath.Join(dir, lockName))
+	if err != nil {
+		return nil, err
+	}
+	s := &JSONStore{dir: dir, backedUp: make(map[string]bool), lock: lock}
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+
+	var meta struct {
+		Version int `json:"version"`
+	}
+	if err := s.read("schema.json", &meta); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	migrations := []migration{
+		{"add calendar feed tokens", func() error { return addFeedTokens(s) }},
+		{"restrict file permissions", s.restrictPermissions},
+		{"per account directories", s.splitAccounts},
+	}
+	err = runMigrations(meta.Version, migrations, func(version int) error {
+		meta.Version = version
+		return s.write("schema.json", meta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// restrictPermissions makes the files written by older versions with 0644
+// only readable by the owner. Only the bot's own files are touched, the
+// directory may be shared with other things.
+func (s *JSONStore) restrictPermissions() error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		switch {
+		case file.IsDir() && name == "snapshots":
+			err = filepath.WalkDir(s.path(name), func(path string, d os.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					return os.Chmod(path, 0700)
+				}
+				return os.Chmod(path, 0600)
+			})
+		case file.IsDir() || !strings.HasSuffix(name, ".json"):
+			continue
+		case strings.HasPrefix(name, "timetable"), ownFiles[name]:
+			err = os.Chmod(s.path(name), 0600)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitAccounts moves the files of the flat layout used before into the
+// account and master data directories. login.json and the raw timetables are
+// not used anymore and removed.
+func (s *JSONStore) splitAccounts() error {
+	move := func(from, to string) error {
+		if _, err := os.Stat(s.path(from)); os.IsNotExist(err) {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(s.path(to)), 0700); err != nil {
+			return err
+		}
+		return os.Rename(s.path(from), s.path(to))
+	}
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		switch {
+		case name == "timetableFilled.json":
+			err = move(name, timetableName(MainAccount))
+		case strings.HasPrefix(name, "timetableFilled_"):
+			id := strings.TrimSuffix(strings.TrimPrefix(name, "timetableFilled_"), ".json")
+			err = move(name, timetableName(id))
+		case name == "login.json", name == "timetable.json", strings.HasPrefix(name, "timetable_"):
+			err = os.Remove(s.path(name))
+		case masterDataKinds[strings.TrimSuffix(name, ".json")]:
+			err = move(name, masterDataName(strings.TrimSuffix(name, ".json")))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	snapshots, err := os.ReadDir(s.path("snapshots"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, dir := range snapshots {
+		if dir.IsDir() {
+			if err := move(filepath.Join("snapshots", dir.Name()), snapshotDir(dir.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Remove(s.path("snapshots")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	prefs := make(map[string]Preferences)
+	if err := s.read("preferences.json", &prefs); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	for userID, p := range prefs {
+		if err := s.write(preferencesName(userID), p); err != nil {
+			return err
+		}
+	}
+	return os.Remove(s.path("preferences.json"))
+}
+
+var logger = Logging.For("store")
+
+var masterDataKinds = map[string]bool{"rooms": true, "classes": true, "subjects": true, "teachers": true}
+
+var ownFiles = map[string]bool{
+	"accounts.json": true, "guilds.json": true, "login.json": true, "preferences.json": true, "outbox.json": true, "schema.json": true,
+	"rooms.json": true, "classes.json": true, "subjects.json": true, "teachers.json": true,
+}
+
+func (s *JSONStore) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// read unmarshals a file, ErrNotFound if it does not exist. A file that is
+// not valid JSON is copied once and reported, it is never treated as empty.
+func (s *JSONStore) read(name string, v interface{}) error {
+	data, err := os.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return ErrNotFound
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		if !s.backedUp[name] {
+			backup, berr := fileutil.Backup(s.path(name))
+			if berr != nil {
+				logger.Error("Corrupt file could not be backed up", "path", s.path(name), "err", berr)
+			} else {
+				logger.Error("Corrupt file is not valid JSON, a copy was saved. Fix or remove the file.", "path", s.path(name), "backup", backup, "err", err)
+				s.backedUp[name] = true
+			}
+		}
+		return fmt.Errorf("%s is corrupt: %w", name, err)
+	}
+	return nil
+}
+
+func (s *JSONStore) write(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.writeRaw(name, data)
+}
+
+func (s *JSONStore) writeRaw(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(s.path(name)), 0700); err != nil {
+		return err
+	}
+	if err := fileutil.WriteFile(s.path(name), data, 0600); err != nil {
+		return err
+	}
+	delete(s.backedUp, name)
+	return nil
+}
+
+func (s *JSONStore) Accounts() ([]Account, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.accounts()
+}
+
+func (s *JSONStore) accounts() ([]Account, error) {
+	var accounts []Account
+	if err := s.read("accounts.json", &accounts); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (s *JSONStore) SaveAccount(acc Account) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	accounts, err := s.accounts()
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i := range accounts {
+		if accounts[i].UserID == acc.UserID {
+			accounts[i] = acc
+			replaced = true
+		}
+	}
+	if !replaced {
+		accounts = append(accounts, acc)
+	}
+	return s.write("accounts.json", accounts)
+}
+
+// RemoveAccount removes the account together with its directory, the
+// timetable, snapshots and preferences
+func (s *JSONStore) RemoveAccount(userID string) error {
+	if userID == "" || userID == "." || userID == ".." || filepath.Base(userID) != userID {
+		return fmt.Errorf("invalid account ID %q", userID)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	accounts, err := s.accounts()
+	if err != nil {
+		return err
+	}
+	kept := accounts[:0]
+	for _, acc := range accounts {
+		if acc.UserID != userID {
+			kept = append(kept, acc)
+		}
+	}
+	if err := s.write("accounts.json", kept); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.path(accountDir(userID)))
+}
+
+func (s *JSONStore) UpdateAccounts(update func(accounts []Account) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	accounts, err := s.accounts()
+	if err != nil {
+		return err
+	}
+	if err := update(accounts); err != nil {
+		return err
+	}
+	return s.write("accounts.json", accounts)
+}
+
+func masterDataName(kind string) string {
+	return filepath.Join("masterdata", filepath.Base(kind)+".json")
+}
+
+func (s *JSONStore) MasterData(kind string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, err := os.ReadFile(s.path(masterDataName(kind)))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *JSONStore) SaveMasterData(kind string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.writeRaw(masterDataName(kind), data)
+}
+
+// accountDir is the directory with everything of one account
+func accountDir(account string) string {
+	return filepath.Join("accounts", filepath.Base(account))
+}
+
+func timetableName(account string) string {
+	return filepath.Join(accountDir(account), "timetable.json")
+}
+
+func (s *JSONStore) Timetable(account string) ([]Untis.NamedTimetableEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var entries []Untis.NamedTimetableEntry
+	err := s.read(timetableName(account), &entries)
+	return entries, err
+}
+
+func (s *JSONStore) SaveTimetable(account string, entries []Untis.NamedTimetableEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write(timetableName(account), entries)
+}
+
+func snapshotDir(account string) string {
+	return filepath.Join(accountDir(account), "snapshots")
+}
+
+func snapshotName(account string, taken time.Time) string {
+	return filepath.Join(snapshotDir(account), snapshotKey(taken)+".json")
+}
+
+func (s *JSONStore) SnapshotTimes(account string) ([]time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	files, err := os.ReadDir(s.path(snapshotDir(account)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var times []time.Time
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok {
+			continue
+		}
+		taken, err := time.Parse(snapshotLayout, name)
+		if err != nil {
+			continue
+		}
+		times = append(times, taken)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times, nil
+}
+
+func (s *JSONStore) Snapshot(account string, taken time.Time) (Snapshot, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var snap Snapshot
+	err := s.read(snapshotName(account, taken), &snap)
+	return snap, err
+}
+
+func (s *JSONStore) SaveSnapshot(snap Snapshot) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write(snapshotName(snap.Account, snap.Taken), snap)
+}
+
+func (s *JSONStore) DeleteSnapshot(account string, taken time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := os.Remove(s.path(snapshotName(account, taken)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func preferencesName(userID string) string {
+	return filepath.Join(accountDir(userID), "preferences.json")
+}
+
+func (s *JSONStore) Preferences(userID string) (Preferences, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var prefs Preferences
+	if err := s.read(preferencesName(userID), &prefs); err != nil && !errors.Is(err, ErrNotFound) {
+		return Preferences{}, err
+	}
+	return prefs, nil
+}
+
+func (s *JSONStore) SavePreferences(userID string, prefs Preferences) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write(preferencesName(userID), prefs)
+}
+
+func (s *JSONStore) guilds() (map[string]Guild, error) {
+	guilds := make(map[string]Guild)
+	if err := s.read("guilds.json", &guilds); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	return guilds, nil
+}
+
+func (s *JSONStore) Guild(guildID string) (Guild, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	guilds, err := s.guilds()
+	if err != nil {
+		return Guild{}, err
+	}
+	g, ok := guilds[guildID]
+	if !ok {
+		g.ID = guildID
+	}
+	return g, nil
+}
+
+func (s *JSONStore) SaveGuild(g Guild) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	guilds, err := s.guilds()
+	if err != nil {
+		return err
+	}
+	guilds[g.ID] = g
+	return s.write("guilds.json", guilds)
+}
+
+func (s *JSONStore) outbox() ([]Message, error) {
+	var messages []Message
+	if err := s.read("outbox.json", &messages); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (s *JSONStore) Enqueue(msg Message) (Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	messages, err := s.outbox()
+	if err != nil {
+		return msg, err
+	}
+	msg.ID = 1
+	if len(messages) > 0 {
+		msg.ID = messages[len(messages)-1].ID + 1
+	}
+	messages = append(messages, msg)
+	return msg, s.write("outbox.json", messages)
+}
+
+func (s *JSONStore) Outbox() ([]Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.outbox()
+}
+
+func (s *JSONStore) UpdateMessage(msg Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	messages, err := s.outbox()
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		if messages[i].ID == msg.ID {
+			messages[i] = msg
+			return s.write("outbox.json", messages)
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *JSONStore) DeleteMessage(id uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	messages, err := s.outbox()
+	if err != nil {
+		return err
+	}
+	kept := messages[:0]
+	for _, msg := range messages {
+		if msg.ID != id {
+			kept = append(kept, msg)
+		}
+	}
+	return s.write("outbox.json", kept)
+}
+
+func (s *JSONStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.lock == nil {
+		return nil
+	}
+	err := unlockFile(s.lock)
+	s.lock = nil
+	return err
+}
@@ -0,0 +1,24 @@
+//go:build !unix
+
+package store
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile takes the lock on path by creating it. Without flock a crashed bot
+// leaves it behind, then it has to be deleted by hand.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return nil, ErrInUse
+	}
+	return f, err
+}
+
+// unlockFile releases a lock taken by lockFile
+func unlockFile(f *os.File) error {
+	f.Close()
+	return os.Remove(f.Name())
+}
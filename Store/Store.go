@@ -0,0 +1,186 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+	Untis "untislogger/Bot"
+)
+
+// ErrNotFound is returned when the requested item is not stored
+var ErrNotFound = errors.New("not found")
+
+// ErrInUse is returned by Open when another process has the store open
+var ErrInUse = errors.New("the store is in use by another untislogger process, stop it first")
+
+// ID of the account configured with UNTIS_USER and UNTIS_PASSWORD
+const MainAccount = "main"
+
+// Account structure to save
+type Account struct {
+	UserID    string `json:"user_id"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`         // encrypted, empty when the account logs in with a secret
+	Secret    string `json:"secret,omitempty"` // encrypted secret of the WebUntis app login
+	FeedToken string `json:"feed_token,omitempty"`
+	GuildID   string `json:"guild_id,omitempty"` // the Discord server the account was added in
+}
+
+// Guild holds the settings of a Discord server
+type Guild struct {
+	ID        string   `json:"id"`
+	AdminRole string   `json:"admin_role,omitempty"` // ID of the role allowed to use the admin commands
+	Blocked   []string `json:"blocked,omitempty"`    // users not allowed to add accounts
+}
+
+// Snapshot is one fetched timetable of an account together with the changes
+// against the snapshot before it
+type Snapshot struct {
+	Account string                      `json:"account"`
+	Taken   time.Time                   `json:"taken"`
+	Entries []Untis.NamedTimetableEntry `json:"entries"`
+	Changes []Untis.Change              `json:"changes,omitempty"`
+}
+
+// Preferences of a Discord user
+type Preferences struct {
+	Paused bool `json:"paused"` // no DMs about timetable changes
+}
+
+// Message is a notification waiting in the outbox until it was delivered
+type Message struct {
+	ID        uint64    `json:"id"`
+	Kind      string    `json:"kind"`             // notifier to deliver it with, e.g. "webhook" or "dm"
+	Target    string    `json:"target,omitempty"` // e.g. the Discord user ID for DMs
+	Content   string    `json:"content"`
+	Created   time.Time `json:"created"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// Store keeps all state of the bot. Implementations are safe for use by
+// several goroutines.
+type Store interface {
+	Accounts() ([]Account, error)
+	SaveAccount(acc Account) error // replaces the account with the same UserID
+	RemoveAccount(userID string) error
+	// UpdateAccounts lets update change the accounts in place and saves all
+	// of them, or none if update or saving fails
+	UpdateAccounts(update func(accounts []Account) error) error
+
+	MasterData(kind string) ([]byte, error)
+	SaveMasterData(kind string, data []byte) error
+
+	Timetable(account string) ([]Untis.NamedTimetableEntry, error)
+	SaveTimetable(account string, entries []Untis.NamedTimetableEntry) error
+
+	SnapshotTimes(account string) ([]time.Time, error) // oldest first
+	Snapshot(account string, taken time.Time) (Snapshot, error)
+	SaveSnapshot(snap Snapshot) error
+	DeleteSnapshot(account string, taken time.Time) error
+
+	Preferences(userID string) (Preferences, error)
+	SavePreferences(userID string, prefs Preferences) error
+
+	Guild(guildID string) (Guild, error) // settings of a guild, empty ones if there are none
+	SaveGuild(g Guild) error
+
+	Enqueue(msg Message) (Message, error) // assigns the ID
+	Outbox() ([]Message, error)           // oldest first
+	UpdateMessage(msg Message) error
+	DeleteMessage(id uint64) error
+
+	Close() error
+}
+
+// Open opens the store of the given kind, "json" keeps every part in its own
+// file inside the directory path, "bolt" keeps everything in the database file
+// path. Without a path the store is put into dataDir.
+func Open(kind, path, dataDir string) (Store, error) {
+	switch kind {
+	case "", "json":
+		if path == "" {
+			path = dataDir
+		}
+		return OpenJSON(path)
+	case "bolt":
+		if path == "" {
+			path = filepath.Join(dataDir, "untislogger.db")
+		}
+		return OpenBolt(path)
+	}
+	return nil, fmt.Errorf("unknown store %q, use json or bolt", kind)
+}
+
+// FindAccount returns the account of a Discord user
+func FindAccount(st Store, userID string) (Account, bool, error) {
+	accounts, err := st.Accounts()
+	if err != nil {
+		return Account{}, false, err
+	}
+	for _, acc := range accounts {
+		if acc.UserID == userID {
+			return acc, true, nil
+		}
+	}
+	return Account{}, false, nil
+}
+
+// NewToken returns a random, URL safe token, e.g. for calendar feeds
+func NewToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Format of snapshot times in file names and database keys, sorts by time
+const snapshotLayout = "20060102T150405.000000000Z"
+
+func snapshotKey(taken time.Time) string {
+	return taken.UTC().Format(snapshotLayout)
+}
+
+type migration struct {
+	name  string
+	apply func() error
+}
+
+// runMigrations applies the migrations after version, save is called with the
+// new version after every applied migration
+func runMigrations(version int, migrations []migration, save func(int) error) error {
+	for i := version; i < len(migrations); i++ {
+		if err := migrations[i].apply(); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", i+1, migrations[i].name, err)
+		}
+		if err := save(i + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addFeedTokens gives accounts saved before calendar feeds existed a token
+func addFeedTokens(st Store) error {
+	accounts, err := st.Accounts()
+	if err != nil {
+		return err
+	}
+	for _, acc := range accounts {
+		if acc.FeedToken != "" {
+			continue
+		}
+		if acc.FeedToken, err = NewToken(); err != nil {
+			return err
+		}
+		if err := st.SaveAccount(acc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+	Untis "untislogger/Bot"
+)
+
+func TestRemoveAccount(t *testing.T) {
+	for _, kind := range []string{"json", "bolt"} {
+		dir := t.TempDir()
+		st, err := Open(kind, "", dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := []Untis.NamedTimetableEntry{{ID: 1, Date: "05-09-2025", StartTime: "07:45"}}
+		for _, id := range []string{"42", "43"} {
+			if err := st.SaveAccount(Account{UserID: id, Username: "anna", FeedToken: "token" + id}); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.SaveTimetable(id, entries); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.SaveSnapshot(Snapshot{Account: id, Taken: time.Now(), Entries: entries}); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.SavePreferences(id, Preferences{Paused: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := st.RemoveAccount("42"); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		// the same user adding the account again starts without the old data
+		if err := st.SaveAccount(Account{UserID: "42", Username: "anna"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := st.Timetable("42"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: the timetable of the removed account is still there: %v", kind, err)
+		}
+		if times, _ := st.SnapshotTimes("42"); len(times) != 0 {
+			t.Errorf("%s: %d snapshots of the removed account are still there", kind, len(times))
+		}
+		if prefs, _ := st.Preferences("42"); prefs.Paused {
+			t.Errorf("%s: the preferences of the removed account are still there", kind)
+		}
+		// the other account is left alone
+		if _, err := st.Timetable("43"); err != nil {
+			t.Errorf("%s: the timetable of another account was removed: %v", kind, err)
+		}
+		if times, _ := st.SnapshotTimes("43"); len(times) != 1 {
+			t.Errorf("%s: the snapshots of another account were removed", kind)
+		}
+		if kind == "json" {
+			if err := st.RemoveAccount(".."); err == nil {
+				t.Error("RemoveAccount(..) was accepted")
+			}
+		}
+		st.Close()
+	}
+}
+
+func TestOpenInUse(t *testing.T) {
+	for _, kind := range []string{"json", "bolt"} {
+		dir := t.TempDir()
+		st, err := Open(kind, "", dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(kind, "", dir); !errors.Is(err, ErrInUse) {
+			t.Errorf("%s: opening it twice: %v, want ErrInUse", kind, err)
+		}
+		if err := st.Close(); err != nil {
+			t.Fatal(err)
+		}
+		st, err = Open(kind, "", dir)
+		if err != nil {
+			t.Fatalf("%s: opening it after Close: %v", kind, err)
+		}
+		st.Close()
+	}
+}
@@ -0,0 +1,167 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	Untis "untislogger/Bot"
+	BotStart "untislogger/Botrun"
+	Logging "untislogger/Logging"
+	Store "untislogger/Store"
+)
+
+// ID of the account configured in the untis section of the config
+const mainAccount = Store.MainAccount
+
+type account struct {
+	ID       string
+	Username string
+	// creds decrypts the credentials, only called when the timetable is not
+	// cached, so a cache hit is no decryption in the audit log
+	creds func() (Untis.Credentials, error)
+}
+
+// lookupAccount returns the main account or a registered bot account by ID
+func lookupAccount(id string) (account, bool) {
+	if id == mainAccount {
+		if conf.Untis.User == "" {
+			return account{}, false
+		}
+		return account{ID: mainAccount, Username: conf.Untis.User, creds: func() (Untis.Credentials, error) {
+			return Untis.MainCredentials(conf.Untis), nil
+		}}, true
+	}
+	acc, ok := BotStart.LookupAccount(id)
+	if !ok {
+		return account{}, false
+	}
+	return botAccount(acc, "web"), true
+}
+
+// botAccount is an account added with !addaccount, its credentials are
+// decrypted for purpose
+func botAccount(acc BotStart.Account, purpose string) account {
+	return account{ID: acc.UserID, Username: acc.Username, creds: func() (Untis.Credentials, error) {
+		return BotStart.AccountCredentials(acc, purpose)
+	}}
+}
+
+// allAccounts lists the main account followed by the registered bot accounts
+func allAccounts() []account {
+	var accounts []account
+	if user := conf.Untis.User; user != "" {
+		accounts = append(accounts, account{ID: mainAccount, Username: user})
+	}
+	for _, acc := range BotStart.Accounts() {
+		accounts = append(accounts, account{ID: acc.UserID, Username: acc.Username})
+	}
+	return accounts
+}
+
+type cachedTimetable struct {
+	entries []Untis.NamedTimetableEntry
+	fetched time.Time
+	used    time.Time // when it was served last, the least recently used ones are dropped first
+}
+
+// timetableFetch is a fetch from Untis other requests for the same timetable
+// wait for instead of logging in themselves
+type timetableFetch struct {
+	done    chan struct{} // closed when the fields below are set
+	entries []Untis.NamedTimetableEntry
+	fetched time.Time
+	err     error
+}
+
+// at most this many timetables are cached, the ranges come from the requests
+const timetableCacheSize = 256
+
+var (
+	timetableCache = make(map[string]cachedTimetable) // account and range -> last fetched timetable
+	fetching       = make(map[string]*timetableFetch) // account and range -> running fetch
+	cacheMutex     sync.Mutex
+)
+
+// fetchTimetable returns the resolved timetable of an account from start to
+// end, fetched live from Untis at most once per timetable_cache_time. If Untis
+// fails an older copy is served when there is one.
+func fetchTimetable(ctx context.Context, acc account, start, end time.Time) ([]Untis.NamedTimetableEntry, time.Time, error) {
+	ctx = Logging.With(ctx, "account", acc.ID)
+	key := cacheKey(acc.ID, start, end)
+	cacheMutex.Lock()
+	cached, ok := timetableCache[key]
+	if ok {
+		cached.used = clock.Now()
+		timetableCache[key] = cached
+		if clock.Now().Sub(cached.fetched) < conf.Schedule.TimetableCacheTime {
+			cacheMutex.Unlock()
+			return cached.entries, cached.fetched, nil
+		}
+	}
+	f, running := fetching[key]
+	if !running {
+		f = &timetableFetch{done: make(chan struct{})}
+		fetching[key] = f
+	}
+	cacheMutex.Unlock()
+	if running {
+		select {
+		case <-f.done:
+			return f.entries, f.fetched, f.err
+		case <-ctx.Done():
+			return nil, time.Time{}, ctx.Err()
+		}
+	}
+
+	creds, err := acc.creds()
+	var entries []Untis.NamedTimetableEntry
+	if err == nil {
+		entries, err = Untis.FetchNamedTimetable(ctx, db, creds, start, end)
+	}
+	cacheMutex.Lock()
+	delete(fetching, key)
+	switch {
+	case err == nil:
+		f.entries, f.fetched = entries, clock.Now()
+		timetableCache[key] = cachedTimetable{entries: f.entries, fetched: f.fetched, used: f.fetched}
+		evictTimetables()
+	case ok:
+		f.entries, f.fetched = cached.entries, cached.fetched
+	default:
+		f.err = err
+	}
+	cacheMutex.Unlock()
+	close(f.done)
+	return f.entries, f.fetched, f.err
+}
+
+func cacheKey(account string, start, end time.Time) string {
+	return fmt.Sprintf("%s/%s/%s", account, start.Format("20060102"), end.Format("20060102"))
+}
+
+// evictTimetables drops the least recently used timetables while there are
+// more than timetableCacheSize, call it with cacheMutex held
+func evictTimetables() {
+	for len(timetableCache) > timetableCacheSize {
+		var oldest string
+		for key, cached := range timetableCache {
+			if oldest == "" || cached.used.Before(timetableCache[oldest].used) {
+				oldest = key
+			}
+		}
+		delete(timetableCache, oldest)
+	}
+}
+
+// forgetAccount drops the cached timetables of a removed account
+func forgetAccount(userID string) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	for key := range timetableCache {
+		if strings.HasPrefix(key, userID+"/") {
+			delete(timetableCache, key)
+		}
+	}
+}
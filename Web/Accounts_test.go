@@ -0,0 +1,109 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	Untis "untislogger/Bot"
+	Config "untislogger/Config"
+	Mock "untislogger/Mock"
+	Store "untislogger/Store"
+)
+
+// setup points the web server at a fake Untis server and an empty store
+func setup(t *testing.T, fixtures Mock.Fixtures) *Mock.Server {
+	t.Helper()
+	mock := Mock.New(fixtures, nil)
+	server := httptest.NewServer(mock)
+	t.Cleanup(server.Close)
+	oldURL := Untis.Url
+	Untis.Url = server.URL + "/WebUntis/jsonrpc.do?school=Demo"
+	st, err := Store.Open("json", "", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, conf = st, Config.Default()
+	t.Cleanup(func() {
+		st.Close()
+		Untis.Url = oldURL
+		cacheMutex.Lock()
+		clear(timetableCache)
+		cacheMutex.Unlock()
+	})
+	return mock
+}
+
+func TestFetchTimetableOnce(t *testing.T) {
+	fixtures := Mock.Default()
+	fixtures.Faults = []Mock.Fault{{Method: "authenticate", Delay: Mock.Duration(100 * time.Millisecond)}}
+	mock := setup(t, fixtures)
+	var decrypted atomic.Int32
+	acc := account{ID: "42", Username: "demo", creds: func() (Untis.Credentials, error) {
+		decrypted.Add(1)
+		return Untis.Credentials{User: "demo", Password: "demo-password"}, nil
+	}}
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := fetchTimetable(context.Background(), acc, start, start)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := mock.Calls("authenticate"); n != 1 {
+		t.Errorf("%d logins for 5 requests at once, want 1", n)
+	}
+	// the second request within timetable_cache_time is served from the cache
+	if _, _, err := fetchTimetable(context.Background(), acc, start, start); err != nil {
+		t.Fatal(err)
+	}
+	if n := mock.Calls("authenticate"); n != 1 {
+		t.Errorf("%d logins after a cached request, want 1", n)
+	}
+	if n := decrypted.Load(); n != 1 {
+		t.Errorf("the credentials were decrypted %d times, want only for the one fetch", n)
+	}
+
+	forgetAccount("4")
+	if len(timetableCache) != 1 {
+		t.Fatal("forgetAccount dropped the timetables of another account")
+	}
+	forgetAccount("42")
+	if len(timetableCache) != 0 {
+		t.Error("the timetables of a removed account are still cached")
+	}
+}
+
+func TestEvictTimetables(t *testing.T) {
+	setup(t, Mock.Default())
+	now := time.Now()
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	for i := 0; i < timetableCacheSize+10; i++ {
+		timetableCache[fmt.Sprint(i)] = cachedTimetable{used: now.Add(time.Duration(i) * time.Second)}
+	}
+	evictTimetables()
+	if len(timetableCache) != timetableCacheSize {
+		t.Fatalf("%d timetables cached, want %d", len(timetableCache), timetableCacheSize)
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := timetableCache[fmt.Sprint(i)]; ok {
+			t.Errorf("the least recently used timetable %d was kept", i)
+		}
+	}
+}
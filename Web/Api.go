@@ -0,0 +1,218 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	Audit "untislogger/Audit"
+	Untis "untislogger/Bot"
+	History "untislogger/History"
+)
+
+// Longest range /timetable answers in one request
+const maxApiDays = 62
+
+// registerApi adds the read only JSON API below /api/v1/. It is only served
+// when API_TOKEN is set, requests have to send it as a bearer token.
+func registerApi(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/accounts", withApiToken(handleAccounts))
+	mux.HandleFunc("GET /api/v1/accounts/{id}/timetable", withApiToken(handleTimetable))
+	mux.HandleFunc("GET /api/v1/accounts/{id}/changes", withApiToken(handleChanges))
+	mux.HandleFunc("GET /api/v1/accounts/{id}/next", withApiToken(handleNext))
+	mux.HandleFunc("GET /api/v1/accounts/{id}/snapshots", withApiToken(handleSnapshots))
+	mux.HandleFunc("GET /api/v1/accounts/{id}/snapshots/{at}", withApiToken(handleSnapshotAt))
+	mux.HandleFunc("GET /api/v1/masterdata/{kind}", withApiToken(handleMasterdata))
+}
+
+func withApiToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := conf.HTTP.APIToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			Audit.Log(Audit.WebLoginFailed, r.RemoteAddr, "", "API token for "+r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("Error writing response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+type accountInfo struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+func handleAccounts(w http.ResponseWriter, r *http.Request) {
+	accounts := []accountInfo{}
+	for _, acc := range allAccounts() {
+		accounts = append(accounts, accountInfo{acc.ID, acc.Username})
+	}
+	writeJSON(w, http.StatusOK, accounts)
+}
+
+// parseDay reads a YYYY-MM-DD query parameter, def is used when it is missing
+func parseDay(r *http.Request, name string, def time.Time) (time.Time, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, true
+	}
+	day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	return day, err == nil
+}
+
+func handleTimetable(w http.ResponseWriter, r *http.Request) {
+	acc, ok := lookupAccount(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown account")
+		return
+	}
+	from, ok := parseDay(r, "from", clock.Now())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "from must be a date like 2006-01-02")
+		return
+	}
+	to, ok := parseDay(r, "to", from)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "to must be a date like 2006-01-02")
+		return
+	}
+	if to.Before(from) || to.Sub(from) > maxApiDays*24*time.Hour {
+		writeError(w, http.StatusBadRequest, "to must be after from and at most 62 days later")
+		return
+	}
+	entries, _, err := fetchTimetable(r.Context(), acc, from, to)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error fetching timetable", "account", acc.ID, "err", err)
+		writeError(w, http.StatusBadGateway, "timetable unavailable")
+		return
+	}
+	if entries == nil {
+		entries = []Untis.NamedTimetableEntry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// handleChanges lists the changes detected between from and to, by default
+// during the last 30 days. to includes the whole day.
+func handleChanges(w http.ResponseWriter, r *http.Request) {
+	acc, ok := lookupAccount(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown account")
+		return
+	}
+	now := clock.Now()
+	from, ok := parseDay(r, "from", now.AddDate(0, 0, -30))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "from must be a date like 2006-01-02")
+		return
+	}
+	to, ok := parseDay(r, "to", now)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "to must be a date like 2006-01-02")
+		return
+	}
+	to = time.Date(to.Year(), to.Month(), to.Day(), 23, 59, 59, 0, time.Local)
+	changes, err := History.Changes(db, acc.ID, from, to)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error reading changes", "account", acc.ID, "err", err)
+		writeError(w, http.StatusInternalServerError, "history unreadable")
+		return
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+func handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	acc, ok := lookupAccount(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown account")
+		return
+	}
+	infos, err := History.List(db, acc.ID)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error reading snapshots", "account", acc.ID, "err", err)
+		writeError(w, http.StatusInternalServerError, "history unreadable")
+		return
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// handleSnapshotAt returns the timetable as it was known at the RFC 3339 time {at}
+func handleSnapshotAt(w http.ResponseWriter, r *http.Request) {
+	acc, ok := lookupAccount(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown account")
+		return
+	}
+	at, err := time.Parse(time.RFC3339, r.PathValue("at"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "time must look like 2006-01-02T15:04:05+02:00")
+		return
+	}
+	snap, found, err := History.At(db, acc.ID, at)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error reading snapshots", "account", acc.ID, "err", err)
+		writeError(w, http.StatusInternalServerError, "history unreadable")
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "no snapshot before that time")
+		return
+	}
+	writeJSON(w, http.StatusOK, snap)
+}
+
+func handleNext(w http.ResponseWriter, r *http.Request) {
+	acc, ok := lookupAccount(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown account")
+		return
+	}
+	entries, err := db.Timetable(acc.ID)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error reading timetable", "account", acc.ID, "err", err)
+		writeError(w, http.StatusServiceUnavailable, "no timetable fetched yet")
+		return
+	}
+	next, found := Untis.NextLesson(entries, clock.Now())
+	if !found {
+		writeError(w, http.StatusNotFound, "no more lessons today")
+		return
+	}
+	writeJSON(w, http.StatusOK, next)
+}
+
+func handleMasterdata(w http.ResponseWriter, r *http.Request) {
+	kind := r.PathValue("kind")
+	switch kind {
+	case "rooms", "classes", "subjects", "teachers":
+	default:
+		writeError(w, http.StatusNotFound, "unknown master data")
+		return
+	}
+	data, err := db.MasterData(kind)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "master data not fetched yet")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	Untis "untislogger/Bot"
+	Clock "untislogger/Clock"
+	Mock "untislogger/Mock"
+)
+
+func TestNextAtFriday(t *testing.T) {
+	setup(t, Mock.Default())
+	conf.Untis.User = "demo"
+	conf.HTTP.APIToken = "token"
+	entries := []Untis.NamedTimetableEntry{
+		{ID: 1, Date: "05-09-2025", StartTime: "13:00", EndTime: "13:45", Su: []string{"M"}, Ro: []string{"A101"}},
+		{ID: 2, Date: "05-09-2025", StartTime: "14:25", EndTime: "15:10", Su: []string{"D"}, Ro: []string{"B202"}},
+		{ID: 3, Date: "05-09-2025", StartTime: "13:50", EndTime: "14:20", Su: []string{"E"}, Ro: []string{"C303"}},
+		{ID: 4, Date: "04-09-2025", StartTime: "13:55", EndTime: "14:40", Su: []string{"B"}, Ro: []string{"A101"}},
+	}
+	if err := db.SaveTimetable(mainAccount, entries); err != nil {
+		t.Fatal(err)
+	}
+	fake := Clock.NewFake(time.Date(2025, 9, 5, 13, 44, 0, 0, time.Local))
+	SetClock(fake)
+	defer SetClock(Clock.Real)
+	mux := http.NewServeMux()
+	registerApi(mux)
+
+	next := func() (int, Untis.NamedTimetableEntry) {
+		req := httptest.NewRequest("GET", "/api/v1/accounts/main/next", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		var entry Untis.NamedTimetableEntry
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, entry
+	}
+	if code, entry := next(); code != http.StatusOK || entry.ID != 3 {
+		t.Errorf("next at 13:44 = %d %+v, want the lesson at 13:50", code, entry)
+	}
+	fake.Set(time.Date(2025, 9, 5, 13, 50, 0, 0, time.Local))
+	if code, entry := next(); code != http.StatusOK || entry.ID != 2 {
+		t.Errorf("next at 13:50 = %d %+v, want the lesson at 14:25", code, entry)
+	}
+	fake.Set(time.Date(2025, 9, 5, 14, 25, 0, 0, time.Local))
+	if code, _ := next(); code != http.StatusNotFound {
+		t.Errorf("next after the last lesson = %d, want 404", code)
+	}
+}
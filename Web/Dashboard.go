@@ -0,0 +1,257 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	Audit "untislogger/Audit"
+	Untis "untislogger/Bot"
+	History "untislogger/History"
+	Status "untislogger/Status"
+)
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"since": sinceText,
+}).ParseFS(templateFiles, "templates/*.html"))
+
+// How many change log entries are shown on an account page
+const dashboardChanges = 30
+
+const dashboardCookie = "untislogger_dashboard"
+
+// registerDashboard adds the web dashboard below /dashboard/. It is only
+// served when DASHBOARD_TOKEN is set, which is also the login password.
+func registerDashboard(mux *http.ServeMux) {
+	mux.HandleFunc("GET /dashboard/login", handleLoginPage)
+	mux.HandleFunc("POST /dashboard/login", handleLogin)
+	mux.HandleFunc("POST /dashboard/logout", handleLogout)
+	mux.HandleFunc("GET /dashboard/{$}", withDashboardLogin(handleOverview))
+	mux.HandleFunc("GET /dashboard/accounts/{id}", withDashboardLogin(handleAccountPage))
+}
+
+// The cookie holds a hash of the token so the token itself is not stored in the browser
+func dashboardSession() string {
+	sum := sha256.Sum256([]byte("untislogger-dashboard:" + conf.HTTP.DashboardToken))
+	return hex.EncodeToString(sum[:])
+}
+
+func withDashboardLogin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conf.HTTP.DashboardToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		cookie, err := r.Cookie(dashboardCookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(dashboardSession())) != 1 {
+			http.Redirect(w, r, "/dashboard/login", http.StatusSeeOther)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := templates.ExecuteTemplate(w, name, data); err != nil {
+		logger.Error("Error rendering", "template", name, "err", err)
+	}
+}
+
+func handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	if conf.HTTP.DashboardToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	render(w, "login.html", map[string]bool{"Failed": r.URL.Query().Has("failed")})
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	token := conf.HTTP.DashboardToken
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostFormValue("token")), []byte(token)) != 1 {
+		Audit.Log(Audit.WebLoginFailed, r.RemoteAddr, "", "dashboard")
+		http.Redirect(w, r, "/dashboard/login?failed", http.StatusSeeOther)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardCookie,
+		Value:    dashboardSession(),
+		Path:     "/dashboard/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(conf.HTTP.PublicURL, "https://"),
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   30 * 24 * 60 * 60,
+	})
+	http.Redirect(w, r, "/dashboard/", http.StatusSeeOther)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: dashboardCookie, Path: "/dashboard/", MaxAge: -1})
+	http.Redirect(w, r, "/dashboard/login", http.StatusSeeOther)
+}
+
+type accountRow struct {
+	ID       string
+	Username string
+	Fetch    Status.Fetch
+}
+
+func handleOverview(w http.ResponseWriter, r *http.Request) {
+	var accounts []accountRow
+	for _, acc := range allAccounts() {
+		fetch, _ := Status.FetchOf(acc.ID)
+		accounts = append(accounts, accountRow{acc.ID, acc.Username, fetch})
+	}
+	render(w, "overview.html", map[string]interface{}{
+		"Accounts":  accounts,
+		"Notifiers": Status.Notifiers(),
+		"Queue":     Status.QueueState(),
+	})
+}
+
+type gridDay struct {
+	Label string
+	Date  string // same format as NamedTimetableEntry.Date
+	Today bool
+}
+
+type gridLesson struct {
+	Subject string
+	Rooms   string
+	Classes string
+	Class   string // css class: cancelled, substituted or empty
+}
+
+type gridRow struct {
+	Start, End string
+	Cells      [][]gridLesson
+}
+
+// weekGrid lays the lessons of one week out as rows of start times and
+// columns of days, saturday and sunday are only added when they have lessons.
+func weekGrid(monday time.Time, entries []Untis.NamedTimetableEntry) ([]gridDay, []gridRow) {
+	today := clock.Now().Format("02-01-2006")
+	dates := make(map[string]bool)
+	for _, entry := range entries {
+		dates[entry.Date] = true
+	}
+	var days []gridDay
+	for i := 0; i < 7; i++ {
+		day := monday.AddDate(0, 0, i)
+		date := day.Format("02-01-2006")
+		if i >= 5 && !dates[date] {
+			continue
+		}
+		days = append(days, gridDay{Label: day.Format("Mon 02.01."), Date: date, Today: date == today})
+	}
+
+	rowsByStart := make(map[string]*gridRow)
+	for _, entry := range entries {
+		row, ok := rowsByStart[entry.StartTime]
+		if !ok {
+			row = &gridRow{Start: entry.StartTime, End: entry.EndTime, Cells: make([][]gridLesson, len(days))}
+			rowsByStart[entry.StartTime] = row
+		}
+		if entry.EndTime > row.End {
+			row.End = entry.EndTime
+		}
+		lesson := gridLesson{
+			Subject: strings.Join(entry.Su, ", "),
+			Rooms:   strings.Join(entry.Ro, ", "),
+			Classes: strings.Join(entry.Kl, ", "),
+		}
+		if lesson.Subject == "" {
+			lesson.Subject = entry.ActivityType
+		}
+		switch entry.Code {
+		case "cancelled":
+			lesson.Class = "cancelled"
+		case "irregular":
+			lesson.Class = "substituted"
+		}
+		for i, day := range days {
+			if day.Date == entry.Date {
+				row.Cells[i] = append(row.Cells[i], lesson)
+			}
+		}
+	}
+	rows := make([]gridRow, 0, len(rowsByStart))
+	for _, row := range rowsByStart {
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Start < rows[j].Start })
+	return days, rows
+}
+
+func handleAccountPage(w http.ResponseWriter, r *http.Request) {
+	acc, ok := lookupAccount(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	week, ok := parseDay(r, "week", clock.Now())
+	if !ok {
+		http.Error(w, "week must be a date like 2006-01-02", http.StatusBadRequest)
+		return
+	}
+	offset := (int(week.Weekday()) + 6) % 7
+	monday := time.Date(week.Year(), week.Month(), week.Day()-offset, 0, 0, 0, 0, time.Local)
+
+	data := map[string]interface{}{
+		"Account":  accountRow{ID: acc.ID, Username: acc.Username},
+		"Week":     monday.Format("02.01.2006"),
+		"PrevWeek": monday.AddDate(0, 0, -7).Format("2006-01-02"),
+		"NextWeek": monday.AddDate(0, 0, 7).Format("2006-01-02"),
+	}
+	fetch, _ := Status.FetchOf(acc.ID)
+	data["Fetch"] = fetch
+
+	entries, fetched, err := fetchTimetable(r.Context(), acc, monday, monday.AddDate(0, 0, 6))
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error fetching timetable", "account", acc.ID, "err", err)
+		data["Error"] = "The timetable could not be fetched from Untis."
+	} else {
+		data["Fetched"] = fetched
+		data["Days"], data["Rows"] = weekGrid(monday, entries)
+	}
+
+	now := clock.Now()
+	changes, err := History.Changes(db, acc.ID, now.AddDate(0, 0, -30), now)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error reading changes", "account", acc.ID, "err", err)
+	}
+	var recent []Untis.Change
+	for i := len(changes) - 1; i >= 0 && len(recent) < dashboardChanges; i-- {
+		recent = append(recent, changes[i])
+	}
+	data["Changes"] = recent
+
+	render(w, "account.html", data)
+}
+
+// sinceText formats how long ago t was, "never" for the zero time
+func sinceText(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	d := clock.Now().Sub(t).Round(time.Second)
+	switch {
+	case d < time.Minute:
+		return d.String() + " ago"
+	case d < 24*time.Hour:
+		return d.Round(time.Minute).String() + " ago"
+	}
+	return t.Format("02.01.2006 15:04")
+}
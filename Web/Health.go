@@ -0,0 +1,138 @@
+package web
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	Metrics "untislogger/Metrics"
+	Status "untislogger/Status"
+	Store "untislogger/Store"
+)
+
+func registerHealth(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /readyz", handleReadyz)
+	mux.HandleFunc("GET /metrics", handleMetrics)
+}
+
+// healthReport is the answer of /healthz and /readyz. Accounts and LastError
+// are only filled in for requests from the same machine or with the API
+// token, they contain Discord user IDs and Untis error messages.
+type healthReport struct {
+	Status    string         `json:"status"` // ok, failing or not ready
+	Problems  []string       `json:"problems,omitempty"`
+	Discord   Status.Gateway `json:"discord"`
+	Outbox    int            `json:"outbox"` // notifications waiting to be delivered
+	Queue     Status.Queue   `json:"queue"`
+	LastError *Status.Error  `json:"lastError,omitempty"`
+	Accounts  []Status.Fetch `json:"accounts,omitempty"`
+}
+
+func newHealthReport(r *http.Request) healthReport {
+	report := healthReport{Status: "ok", Discord: Status.GatewayState(), Queue: Status.QueueState()}
+	if messages, err := db.Outbox(); err == nil {
+		report.Outbox = len(messages)
+	} else {
+		report.Outbox = -1
+		report.Problems = append(report.Problems, "the outbox can not be read: "+err.Error())
+	}
+	if showDetails(r) {
+		report.LastError = Status.LastError()
+		report.Accounts = Status.Fetches()
+	}
+	return report
+}
+
+// handleHealthz fails when the bot is alive but not doing its job: the main
+// account or all accounts have been failing for longer than unhealthy_after,
+// the main account was not fetched for that long or Discord has been
+// disconnected that long. One account with a wrong password does not fail it.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	report := newHealthReport(r)
+	report.Problems = append(report.Problems, healthProblems(clock.Now())...)
+	status := http.StatusOK
+	if len(report.Problems) > 0 {
+		report.Status = "failing"
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+func healthProblems(now time.Time) []string {
+	limit := conf.HTTP.UnhealthyAfter
+	var problems []string
+	fetches := Status.Fetches()
+	failing := 0
+	for _, f := range fetches {
+		if !f.Failing || now.Sub(f.FailingSince) <= limit {
+			continue
+		}
+		failing++
+		if f.Account == Store.MainAccount {
+			problems = append(problems, fmt.Sprintf("fetching the main account has been failing since %s", f.FailingSince.Format(time.RFC3339)))
+		}
+	}
+	if failing > 1 && failing == len(fetches) {
+		problems = append(problems, fmt.Sprintf("fetching all %d accounts has been failing for more than %s", failing, limit))
+	}
+	if conf.Untis.User != "" {
+		// the main account is fetched every check_interval, if it was not the loop is stuck
+		if f, ok := Status.FetchOf(Store.MainAccount); ok && now.Sub(f.LastAttempt) > limit+conf.Schedule.CheckInterval {
+			problems = append(problems, fmt.Sprintf("the main account was not fetched since %s", f.LastAttempt.Format(time.RFC3339)))
+		}
+	}
+	if gw := Status.GatewayState(); gw.Enabled && !gw.Connected && now.Sub(gw.Since) > limit {
+		problems = append(problems, fmt.Sprintf("disconnected from Discord since %s", gw.Since.Format(time.RFC3339)))
+	}
+	return problems
+}
+
+// handleReadyz fails while the bot is starting or shutting down: before it
+// is connected to Discord, when the store can not be read and after the
+// shutdown began
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := newHealthReport(r)
+	if running.Err() != nil {
+		report.Problems = append(report.Problems, "shutting down")
+	}
+	if conf.Discord.Token != "" && !report.Discord.Connected {
+		report.Problems = append(report.Problems, "not connected to Discord")
+	}
+	status := http.StatusOK
+	if len(report.Problems) > 0 {
+		report.Status = "not ready"
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// handleMetrics writes the metrics for Prometheus, with the metrics token
+// when one is set
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if token := conf.HTTP.MetricsToken; token != "" {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	Metrics.Write(w)
+}
+
+// showDetails reports whether r comes from the same machine or has the API token
+func showDetails(r *http.Request) bool {
+	if given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && conf.HTTP.APIToken != "" {
+		return subtle.ConstantTimeCompare([]byte(given), []byte(conf.HTTP.APIToken)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback() && r.Header.Get("X-Forwarded-For") == ""
+}
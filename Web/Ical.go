@@ -0,0 +1,123 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	Untis "untislogger/Bot"
+	BotStart "untislogger/Botrun"
+)
+
+// feedRange returns the first and last day of a feed: the previous week and
+// http.ical_weeks weeks starting with the current one
+func feedRange(now time.Time) (time.Time, time.Time) {
+	offset := (int(now.Weekday()) + 6) % 7 // days since monday
+	monday := time.Date(now.Year(), now.Month(), now.Day()-offset, 0, 0, 0, 0, now.Location())
+	return monday.AddDate(0, 0, -7), monday.AddDate(0, 0, 7*conf.HTTP.IcalWeeks-1)
+}
+
+func handleIcal(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/ical/")
+	token, ok := strings.CutSuffix(name, ".ics")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	acc, ok := BotStart.FeedAccount(token)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	start, end := feedRange(clock.Now())
+	entries, fetched, err := fetchTimetable(r.Context(), botAccount(acc, "calendar feed"), start, end)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "Error fetching calendar feed", "account", acc.UserID, "err", err)
+		http.Error(w, "timetable unavailable", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="timetable.ics"`)
+	writeIcal(w, "Untis "+acc.Username, entries, fetched)
+}
+
+// writeIcal writes the lessons as an iCalendar (RFC 5545) document
+func writeIcal(w io.Writer, name string, entries []Untis.NamedTimetableEntry, stamp time.Time) {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//untislogger//timetable//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:" + icalEscape(name),
+	}
+	for _, entry := range entries {
+		start, err := time.ParseInLocation("02-01-2006 15:04", entry.Date+" "+entry.StartTime, time.Local)
+		if err != nil {
+			continue
+		}
+		end, err := time.ParseInLocation("02-01-2006 15:04", entry.Date+" "+entry.EndTime, time.Local)
+		if err != nil {
+			continue
+		}
+		summary := strings.Join(entry.Su, ", ")
+		if summary == "" {
+			summary = entry.ActivityType
+		}
+		description := "Classes: " + strings.Join(entry.Kl, ", ")
+		if entry.Code == "irregular" {
+			summary += " (substitution)"
+		}
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:%d@untislogger", entry.ID),
+			"DTSTAMP:"+stamp.UTC().Format("20060102T150405Z"),
+			"DTSTART:"+start.UTC().Format("20060102T150405Z"),
+			"DTEND:"+end.UTC().Format("20060102T150405Z"),
+			"SUMMARY:"+icalEscape(summary),
+			"LOCATION:"+icalEscape(strings.Join(entry.Ro, ", ")),
+			"DESCRIPTION:"+icalEscape(description),
+		)
+		if entry.Code == "cancelled" {
+			lines = append(lines, "STATUS:CANCELLED")
+		} else {
+			lines = append(lines, "STATUS:CONFIRMED")
+		}
+		lines = append(lines, "END:VEVENT")
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, line := range lines {
+		io.WriteString(w, icalFold(line)+"\r\n")
+	}
+}
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+func icalEscape(s string) string {
+	return icalEscaper.Replace(s)
+}
+
+// icalFold splits lines longer than 75 octets, continuation lines start with a space
+func icalFold(line string) string {
+	if len(line) <= 75 {
+		return line
+	}
+	var b strings.Builder
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 { // do not split UTF-8 sequences
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74 // the leading space counts
+	}
+	b.WriteString(line)
+	return b.String()
+}
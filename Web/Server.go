@@ -0,0 +1,79 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	BotStart "untislogger/Botrun"
+	Clock "untislogger/Clock"
+	Config "untislogger/Config"
+	Logging "untislogger/Logging"
+	Store "untislogger/Store"
+)
+
+var logger = Logging.For("web")
+
+var (
+	db      Store.Store            // set by Start
+	conf    = Config.Default()     // set by Start
+	running = context.Background() // done when shutting down, set by Start
+	clock   = Clock.Real           // set by SetClock
+)
+
+// SetClock sets the clock of the next lesson, the default ranges and the
+// timetable cache, call it before Start
+func SetClock(c Clock.Clock) {
+	clock = c
+}
+
+// Start runs the embedded HTTP server on the configured address serving the
+// data in st. When ctx is done it stops taking requests and waits up to
+// shutdown_timeout for the running ones. It blocks until the server stopped,
+// so call it in its own goroutine.
+func Start(ctx context.Context, cfg *Config.Config, st Store.Store) {
+	db = st
+	conf = cfg
+	running = ctx
+	BotStart.OnRemove(forgetAccount)
+	addr := cfg.HTTP.Addr
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ical/", handleIcal)
+	registerApi(mux)
+	registerDashboard(mux)
+	registerHealth(mux)
+
+	// requests keep the values of ctx but are not cancelled with it, so the
+	// running ones can finish within shutdown_timeout
+	base := context.WithoutCancel(ctx)
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     withLogContext(mux),
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdown); err != nil {
+			logger.Error("Error stopping HTTP server", "err", err)
+		}
+	}()
+
+	logger.Info("HTTP server listening", "addr", addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("HTTP server stopped", "err", err)
+		return
+	}
+	<-stopped
+}
+
+// withLogContext adds the request to the log entries written while handling it
+func withLogContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := Logging.With(r.Context(), "request", r.Method+" "+r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
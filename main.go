@@ -2,169 +2,363 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sort"
+	"sync"
 	"syscall"
 	"time"
+	Audit "untislogger/Audit"
 	Untis "untislogger/Bot"
+	Cassette "untislogger/Cassette"
+	Clock "untislogger/Clock"
 
 	BotStart "untislogger/Botrun"
+	Config "untislogger/Config"
+	History "untislogger/History"
+	Logging "untislogger/Logging"
+	Metrics "untislogger/Metrics"
+	Notify "untislogger/Notify"
+	Secrets "untislogger/Secrets"
+	Status "untislogger/Status"
+	Store "untislogger/Store"
+	Web "untislogger/Web"
+)
+
+type NamedTimetableEntry = Untis.NamedTimetableEntry
+
+var (
+	db    Store.Store    // opened in main
+	conf  *Config.Config // loaded in main
+	clock = Clock.Real   // the clock of the schedule, fake in tests and replays
 
-	"github.com/joho/godotenv"
+	loops sync.WaitGroup // the fetch loops of the main account, waited for on shutdown
 )
 
-type NamedTimetableEntry struct {
-	ID           int      `json:"id"`
-	Date         string   `json:"date"`
-	StartTime    string   `json:"startTime"`
-	EndTime      string   `json:"endTime"`
-	Code         string   `json:"code,omitempty"`
-	Statflags    string   `json:"statflags,omitempty"`
-	Kl           []string `json:"kl"`
-	Su           []string `json:"su"`
-	Ro           []string `json:"ro"`
-	ActivityType string   `json:"activityType"`
-}
+var logger = Logging.For("main")
 
-// init and main//
-func init() {
-	godotenv.Load(".env")
-	err := godotenv.Load()
+func main() {
+	configFile := flag.String("config", "", "config file, default CONFIG_FILE or config.yaml")
+	dryRun := flag.Bool("dry-run", false, "print notifications instead of sending them, like notifiers.dry_run (DRY_RUN)")
+	flag.Usage = usage
+	flag.Parse()
+	// cancelled on Ctrl+C or when the service is stopped, everything stops with it
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	cfg, err := Config.Load(*configFile)
 	if err != nil {
-		log.Printf("Error loading .env file: %v", err)
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	Logging.AddSecret(cfg.Secrets()...)
+	if err := Logging.Setup(os.Stderr, cfg.Log.Format, cfg.Log.Level); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	if *dryRun {
+		cfg.Notifiers.DryRun = true
+	}
+	conf = cfg
+	Untis.Url = cfg.Untis.URL()
+	History.SetRetention(cfg.Storage.SnapshotRetentionDays, cfg.Storage.SnapshotMax)
+	discordWebhookURL = cfg.Notifiers.WebhookURL
+	if cfg.Untis.Record != "" {
+		recorder, err := Cassette.Record(cfg.Untis.Record, nil)
+		if err != nil {
+			fatal("Error opening the cassette", err)
+		}
+		defer recorder.Close()
+		Untis.Client = &http.Client{Transport: recorder}
+		logger.Info("Recording Untis requests", "file", cfg.Untis.Record)
 	}
-	discordWebhookURL = os.Getenv("DISCORD_WEBHOOK_URL")
-	log.Println("Initializing application...")
-	log.Printf("DISCORD_WEBHOOK_URL: %q", discordWebhookURL)
 
+	dataDir := cfg.DataDir
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		fatal("Error creating data directory", err)
+	}
+	st, err := Store.Open(cfg.Storage.Kind, cfg.Storage.Path, dataDir)
+	if err != nil {
+		fatal("Error opening store", err)
+	}
+	defer st.Close()
+	db = st
+	BotStart.SetStore(db)
+	if cfg.Notifiers.DryRun {
+		out, err := dryRunOutput(cfg.Notifiers.DryRunFile)
+		if err != nil {
+			fatal("Error opening the dry run file", err)
+		}
+		defer out.Close()
+		Notify.DryRun(out)
+		logger.Info("Dry run, notifications are printed instead of sent", "file", cfg.Notifiers.DryRunFile)
+	}
+	Audit.Open(filepath.Join(dataDir, "audit.jsonl"), cfg.Storage.AuditRetentionDays)
+	keys, keysErr := Secrets.Load(cfg.Encryption, dataDir)
+	if keysErr == nil {
+		keys.AllowLegacy(cfg.Encryption.AllowLegacy)
+		if err := keys.CheckLegacy(db); err != nil {
+			logger.Error("Error checking for passwords in the old formats", "err", err)
+		}
+	}
+
+	switch flag.Arg(0) {
+	case "", "serve":
+		if keysErr != nil {
+			logger.Error("Error reading encryption keys, accounts added with !addaccount are disabled", "err", keysErr)
+			keys = nil
+		}
+		BotStart.SetKeys(keys)
+		serve(ctx, cfg)
+	case "rotate-keys":
+		if keysErr != nil {
+			fatal("Error reading encryption keys", keysErr)
+		}
+		rotateKeys(keys)
+	default:
+		// the other commands only need the keys for accounts added with !addaccount
+		if keysErr == nil {
+			BotStart.SetKeys(keys)
+		}
+		if err := runCommand(ctx, flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			st.Close()
+			os.Exit(1)
+		}
+	}
+}
+
+// dryRunOutput opens the file dry run notifications are appended to, stdout
+// if file is empty
+func dryRunOutput(file string) (io.WriteCloser, error) {
+	if file == "" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	logger.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// serve runs the bot, the webhook schedule and the web server until ctx is
+// done, then shuts them down within shutdown_timeout
+func serve(ctx context.Context, cfg *Config.Config) {
+	logger.Info("Initializing application...")
 	// Check if Discord webhook is configured
 	if discordWebhookURL != "" {
-		log.Println("Discord webhook configured")
+		logger.Info("Discord webhook configured")
 	} else {
-		log.Println("No Discord webhook provided, Discord notifications will be disabled")
+		logger.Info("No Discord webhook provided, Discord notifications will be disabled")
 	}
+	Notify.Register("webhook", deliverWebhook)
+	Notify.Start(ctx, db, cfg.QuietHours)
+	//Starts logging the timetable for each new Lesson and logs changes
+	BotStart.Start(ctx, cfg)
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		Web.Start(ctx, cfg, db)
+	}()
+	scheduleTimetableUpdate(ctx)
+
+	logger.Info("Program is running. Press Ctrl+C to stop.")
+	<-ctx.Done()
+	logger.Info("Shutting down...")
+	shutdown(cfg)
 }
 
-func main() {
-	godotenv.Load(".env")
-	//Untis.Main() //starting API calls function| happens in schedule func
-	//Run()
-	//Starts logging the timetable for each new Lesson and logs changes
-	go BotStart.Start()
-	scheduleTimetableUpdate()
-
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	log.Println("Program is running. Press Ctrl+C to stop.")
-	//Start logging
-	//Run()
-	// Block until we receive a signal
-	<-sigChan
-	log.Println("Shutting down...")
+// shutdown waits for the web server and the running fetches, delivers the
+// queued notifications and closes the Discord connection. Untis sessions are
+// logged out as the fetches end. Whatever is not done in time is left behind,
+// the outbox keeps undelivered messages for the next start.
+func shutdown(cfg *Config.Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		loops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Warn("Timed out waiting for the main account and the web server")
+	}
+	if err := BotStart.Wait(ctx); err != nil {
+		logger.Warn("Timed out waiting for the running fetches")
+	}
+	Notify.Drain(ctx)
+	BotStart.Close()
+	logger.Info("Stopped")
 }
+
+// isScheduledTime reports whether now is one of the lesson_times of the schedule
 func isScheduledTime(now time.Time) bool {
-	scheduled := []string{"07:45", "08:35", "09:35", "10:25", "11:25", "12:15", "13:45", "14:25"}
 	current := now.Format("15:04")
-	for _, t := range scheduled {
+	for _, t := range conf.Schedule.LessonTimes {
 		if t == current {
 			return true
 		}
 	}
 	return false
 }
-func scheduleTimetableUpdate() {
-	var prevData []byte
-	//declare user and pass
-	godotenv.Load(".env")
-	var password = os.Getenv("UNTIS_PASSWORD")
-	var user = os.Getenv("UNTIS_USER")
-	Untis.Main(user, password)
-	// Initial read of the file
-	data, err := os.ReadFile("timetableFilled.json")
+
+// scheduleTimetableUpdate fetches the main account every check_interval and
+// at the lesson_times, until ctx is done
+func scheduleTimetableUpdate(ctx context.Context) {
+	//declare user and pass (or app secret)
+	creds := Untis.MainCredentials(conf.Untis)
+	fetchMain(ctx, creds)
+	// Initial read of the timetable
+	entries, err := db.Timetable(Store.MainAccount)
 	if err == nil {
-		prevData = data
+		recordSnapshot(entries)
 	}
 
-	// Ticker for checking timetable changes every hour
-	hourTicker := time.NewTicker(1 * time.Minute)
+	// Check for timetable changes every check_interval
+	loops.Add(1)
 	go func() {
-		for range hourTicker.C {
-			Untis.Main(user, password)
-			data, err := os.ReadFile("timetableFilled.json")
-			if err != nil {
-				log.Printf("Error reading timetable: %v", err)
-			} else if !bytes.Equal(data, prevData) {
-				log.Println("Timetable file has changed.")
-				sendUpdateDiscordWebhook()
-				prevData = data
+		defer loops.Done()
+		for {
+			select {
+			case <-clock.After(conf.Schedule.CheckInterval):
+			case <-ctx.Done():
+				return
 			}
-			// Trigger bot notifications for all users
-			BotStart.NotifyAllUsers()
+			// the accounts added with !addaccount are fetched by BotStart.Start
+			checkMainTimetable(ctx, creds)
 		}
 	}()
 
 	// Ticker for checking scheduled times every minute
-	startMinuteTicker(func() {
-		now := time.Now()
+	startMinuteTicker(ctx, func(now time.Time) {
 		if isScheduledTime(now) {
-			log.Println("Scheduled time reached, updating and running Run()")
-			Untis.Main(user, password)
-			log.Println("Updated now running Run()")
-			Run()
-			log.Println("Finished running Run")
+			logger.Info("Scheduled time reached, updating and running Run()")
+			fetchMain(ctx, creds)
+			logger.Debug("Updated now running Run()")
+			Run(now)
+			logger.Debug("Finished running Run")
 		}
 	})
 }
 
-func startMinuteTicker(f func()) {
-	now := time.Now()
-	next := now.Truncate(time.Minute).Add(time.Minute)
-	time.Sleep(time.Until(next))
-	ticker := time.NewTicker(1 * time.Minute)
-	go func() {
-		for {
-			f()
-			<-ticker.C
-		}
-	}()
+// checkMainTimetable fetches the main account and posts to the webhook when
+// lessons changed against its last snapshot, like the DMs of the other
+// accounts. A new day or the same lessons in another order post nothing. It
+// returns the number of changes.
+func checkMainTimetable(ctx context.Context, creds Untis.Credentials) int {
+	fetchMain(ctx, creds)
+	entries, err := db.Timetable(Store.MainAccount)
+	if err != nil {
+		logger.Error("Error reading timetable", "err", err)
+		return 0
+	}
+	changes := recordSnapshot(entries)
+	if len(changes) > 0 {
+		logger.Info("Timetable has changed", "changes", len(changes))
+		sendUpdateDiscordWebhook()
+	}
+	return len(changes)
 }
 
-/*
-#Main Run Function
-*/
-func Run() {
-	log.Println("Sending next Lesson")
-	codeByStartTime, err := MapTimeToCode("timetableFilled.json")
+// rotateKeys re-encrypts the stored passwords with the first configured key
+func rotateKeys(keys *Secrets.Keyring) {
+	n, err := keys.Rotate(db)
 	if err != nil {
-		log.Println(err)
+		fatal("Error re-encrypting passwords, nothing was changed", err)
 	}
+	logger.Info("Re-encrypted passwords", "count", n, "key", keys.Primary())
+	Audit.Log(Audit.KeysRotated, "rotate-keys", "", fmt.Sprintf("%d accounts re-encrypted with key %s", n, keys.Primary()))
+}
+
+// fetchMain updates the timetable of the main account and records the result
+func fetchMain(ctx context.Context, creds Untis.Credentials) {
+	start := time.Now()
+	err := Untis.Main(ctx, db, Store.MainAccount, creds)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error updating timetable", "account", Store.MainAccount, "err", err)
+	}
+	Status.RecordFetch("main", time.Since(start), err)
+}
 
-	roomByStartTime, err := MapTimeToRoom("timetableFilled.json")
+// recordSnapshot stores the timetable in the history of the main account and
+// returns its changes against the last snapshot
+func recordSnapshot(entries []NamedTimetableEntry) []Untis.Change {
+	changes, err := History.Record(db, Store.MainAccount, entries, clock.Now())
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("Error saving timetable snapshot", "account", Store.MainAccount, "err", err)
 	}
-	subjectByStartTime, err := MapTimeToSubject("timetableFilled.json")
+	return changes
+}
+
+// startMinuteTicker runs f with the time at the start of every minute until
+// ctx is done
+func startMinuteTicker(ctx context.Context, f func(now time.Time)) {
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		for {
+			start := clock.Now()
+			next := start.Truncate(time.Minute).Add(time.Minute)
+			select {
+			case <-clock.After(next.Sub(start)):
+			case <-ctx.Done():
+				return
+			}
+			// how late the tick came after the start of the minute
+			now := clock.Now()
+			Metrics.SchedulerLag.ObserveDuration(now.Sub(next), "minute")
+			f(now)
+		}
+	}()
+}
+
+// useClock makes the schedule, the fetches and the notifications use c
+func useClock(c Clock.Clock) {
+	clock = c
+	Untis.SetClock(c)
+	BotStart.SetClock(c)
+	Notify.SetClock(c)
+	Status.SetClock(c)
+	Web.SetClock(c)
+}
+
+// Run posts the next lesson after now to the webhook
+func Run(now time.Time) {
+	logger.Info("Sending next Lesson")
+	table, err := db.Timetable(Store.MainAccount)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("Error reading timetable", "err", err)
+		return
 	}
-	now := time.Now().Format("15:04")
+	codeByStartTime := MapTimeToCode(table)
+	roomByStartTime := MapTimeToRoom(table)
+	subjectByStartTime := MapTimeToSubject(table)
 	nextTime, room, found := NextRoomForTime(roomByStartTime, now)
 	if found {
-		log.Println("found Room")
+		logger.Debug("Found Room")
 		Subject, found := NextSubjectForTime(subjectByStartTime, now)
 		if found {
-			log.Println("Found Subject")
+			logger.Debug("Found Subject")
 			Status, found := NextCodeForTime(codeByStartTime, now)
 			if found {
-				log.Println("Found Status")
-				fmt.Printf("Next time: %s, Room: %s\n", nextTime, room)
+				logger.Debug("Found Status")
+				logger.Info("Next lesson", "time", nextTime, "room", room)
 				sendDiscordWebhook(Subject, room, nextTime, Status)
 			} else {
 				sendDiscordWebhook(Subject, room, nextTime, "")
@@ -174,66 +368,35 @@ func Run() {
 
 }
 
-/*
- */
-func NextRoomForTime(roomByStartTime map[string]string, current string) (string, string, bool) {
-	layout := "15:04"
-	now, err := time.Parse(layout, current)
-	if err != nil {
-		return "", "", false
-	}
-	var times []time.Time
-	timeToStr := make(map[time.Time]string)
-	for t := range roomByStartTime {
-		parsed, err := time.Parse(layout, t)
-		if err != nil {
-			continue
-		}
-		times = append(times, parsed)
-		timeToStr[parsed] = t
-	}
-	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
-	for _, t := range times {
-		if t.After(now) {
-			return timeToStr[t], roomByStartTime[timeToStr[t]], true
-		}
-	}
-	return "", "", false
+// NextRoomForTime returns the start time and room of the first lesson
+// starting after the time of day of now
+func NextRoomForTime(roomByStartTime map[string]string, now time.Time) (string, string, bool) {
+	next, found := nextStartTime(roomByStartTime, now)
+	return next, roomByStartTime[next], found
 }
-func NextSubjectForTime(subjectByStartTime map[string]string, current string) (string, bool) {
-	layout := "15:04"
-	now, err := time.Parse(layout, current)
-	if err != nil {
-		return "", false
-	}
-	var times []time.Time
-	timeToStr := make(map[time.Time]string)
-	for t := range subjectByStartTime {
-		parsed, err := time.Parse(layout, t)
-		if err != nil {
-			continue
-		}
-		times = append(times, parsed)
-		timeToStr[parsed] = t
-	}
-	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
-	for _, t := range times {
-		if t.After(now) {
-			return subjectByStartTime[timeToStr[t]], true
-		}
-	}
-	return "", false
+
+// NextSubjectForTime returns the subject of the first lesson starting after
+// the time of day of now
+func NextSubjectForTime(subjectByStartTime map[string]string, now time.Time) (string, bool) {
+	next, found := nextStartTime(subjectByStartTime, now)
+	return subjectByStartTime[next], found
 }
-func NextCodeForTime(codeByStartTime map[string]string, current string) (string, bool) {
 
-	layout := "15:04"
-	now, err := time.Parse(layout, current)
-	if err != nil {
-		return "", false
-	}
+// NextCodeForTime returns the code, like cancelled, of the first lesson with
+// a code starting after the time of day of now
+func NextCodeForTime(codeByStartTime map[string]string, now time.Time) (string, bool) {
+	next, found := nextStartTime(codeByStartTime, now)
+	return codeByStartTime[next], found
+}
+
+// nextStartTime returns the earliest of the "15:04" keys of byStartTime that
+// is after the time of day of now, keys that are no time are skipped
+func nextStartTime(byStartTime map[string]string, now time.Time) (string, bool) {
+	const layout = "15:04"
+	current, _ := time.Parse(layout, now.Format(layout))
 	var times []time.Time
 	timeToStr := make(map[time.Time]string)
-	for t := range codeByStartTime {
+	for t := range byStartTime {
 		parsed, err := time.Parse(layout, t)
 		if err != nil {
 			continue
@@ -243,41 +406,23 @@ func NextCodeForTime(codeByStartTime map[string]string, current string) (string,
 	}
 	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
 	for _, t := range times {
-		if t.After(now) {
-			return codeByStartTime[timeToStr[t]], true
+		if t.After(current) {
+			return timeToStr[t], true
 		}
 	}
 	return "", false
-
 }
-func MapTimeToRoom(path string) (map[string]string, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	var table []NamedTimetableEntry
-	err = json.Unmarshal(data, &table)
-	if err != nil {
-		return nil, err
-	}
+
+func MapTimeToRoom(table []NamedTimetableEntry) map[string]string {
 	roomByStartTime := make(map[string]string)
 	for _, entry := range table {
 		if len(entry.Ro) > 0 {
 			roomByStartTime[entry.StartTime] = entry.Ro[0]
 		}
 	}
-	return roomByStartTime, nil
+	return roomByStartTime
 }
-func MapTimeToCode(path string) (map[string]string, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	var table []NamedTimetableEntry
-	err = json.Unmarshal(data, &table)
-	if err != nil {
-		return nil, err
-	}
+func MapTimeToCode(table []NamedTimetableEntry) map[string]string {
 	codeByStartTime := make(map[string]string)
 	for _, entry := range table {
 		if len(entry.Code) > 0 {
@@ -286,30 +431,21 @@ func MapTimeToCode(path string) (map[string]string, error) {
 			}
 		}
 	}
-	return codeByStartTime, nil
+	return codeByStartTime
 }
-func MapTimeToSubject(path string) (map[string]string, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	var table []NamedTimetableEntry
-	err = json.Unmarshal(data, &table)
-	if err != nil {
-		return nil, err
-	}
+func MapTimeToSubject(table []NamedTimetableEntry) map[string]string {
 	subjectByStartTime := make(map[string]string)
 	for _, entry := range table {
 		if len(entry.Su) > 0 {
 			subjectByStartTime[entry.StartTime] = entry.Su[0]
 		}
 	}
-	return subjectByStartTime, nil
+	return subjectByStartTime
 }
 
 // Discord webhook configuration
 
-var discordWebhookURL string // Webhook URL from environment variable
+var discordWebhookURL string // Webhook URL from notifiers.webhook_url
 
 // DiscordWebhookPayload represents the structure for Discord webhook messages
 type DiscordWebhookPayload struct {
@@ -332,7 +468,7 @@ type Field struct {
 }
 
 func sendDiscordWebhook(subject string, room string, nextTime string, Status string) {
-	log.Println("Sending Discord webhook notification...")
+	logger.Info("Sending Discord webhook notification...")
 	// Create a rich embed message
 	var message string
 	if Status != "" {
@@ -346,33 +482,11 @@ func sendDiscordWebhook(subject string, room string, nextTime string, Status str
 			subject, room, nextTime,
 		)
 	}
-	payload := DiscordWebhookPayload{
-		Content: message,
-	}
-
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Error marshaling webhook payload: %v", err)
-		return
-	}
-
-	resp, err := http.Post(discordWebhookURL, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Printf("Error sending Discord webhook: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		log.Println("Discord webhook notification sent successfully")
-	} else {
-		body, _ := ioutil.ReadAll(resp.Body)
-		log.Printf("Discord webhook failed with status %d: %s", resp.StatusCode, string(body))
-	}
+	postWebhook(message)
 }
 
 func sendUpdateDiscordWebhook() {
-	log.Println("Sending Discord webhook notification...")
+	logger.Info("Sending Discord webhook notification...")
 	// Create a rich embed message
 	message := "A lesson on your timetable has changed"
 	/*embed := Embed{
@@ -400,27 +514,46 @@ func sendUpdateDiscordWebhook() {
 		},
 	}
 	*/
+	postWebhook(message)
+}
+
+// postWebhook queues a plain message for the Discord webhook
+func postWebhook(message string) {
+	if discordWebhookURL == "" && !conf.Notifiers.DryRun {
+		return
+	}
+	Notify.Send("webhook", "", message)
+}
+
+// deliverWebhook sends a message from the outbox to the Discord webhook
+func deliverWebhook(ctx context.Context, target, message string) error {
 	payload := DiscordWebhookPayload{
 		Content: message,
 	}
 
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshaling webhook payload: %v", err)
-		return
+		logger.Error("Error marshaling webhook payload", "err", err)
+		return err
 	}
 
-	resp, err := http.Post(discordWebhookURL, "application/json", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", discordWebhookURL, bytes.NewBuffer(jsonData))
 	if err != nil {
-		log.Printf("Error sending Discord webhook: %v", err)
-		return
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error sending Discord webhook", "err", err)
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		log.Println("Discord webhook notification sent successfully")
-	} else {
-		body, _ := ioutil.ReadAll(resp.Body)
-		log.Printf("Discord webhook failed with status %d: %s", resp.StatusCode, string(body))
+		logger.InfoContext(ctx, "Discord webhook notification sent successfully")
+		return nil
 	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	logger.ErrorContext(ctx, "Discord webhook failed", "status", resp.StatusCode, "body", string(body))
+	return fmt.Errorf("status %d", resp.StatusCode)
 }
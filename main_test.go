@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	Untis "untislogger/Bot"
+	Clock "untislogger/Clock"
+	Config "untislogger/Config"
+	History "untislogger/History"
+	Mock "untislogger/Mock"
+	Notify "untislogger/Notify"
+	Store "untislogger/Store"
+)
+
+var day = map[string]string{"07:45": "A101", "08:35": "A102", "10:40": "B202"}
+
+// at returns the time on Friday, 5 September 2025
+func at(hour, minute int) time.Time {
+	return time.Date(2025, 9, 5, hour, minute, 0, 0, time.Local)
+}
+
+func TestNextRoomForTime(t *testing.T) {
+	tests := []struct {
+		now              time.Time
+		wantTime, wantRo string
+		found            bool
+	}{
+		{at(7, 0), "07:45", "A101", true},
+		{at(7, 45), "08:35", "A102", true}, // the lesson that starts now is not next
+		{at(9, 0), "10:40", "B202", true},
+		{at(10, 40), "", "", false},
+		{at(23, 59), "", "", false},
+		{at(7, 0).AddDate(0, 0, 3), "07:45", "A101", true}, // only the time of day counts
+	}
+	for _, tt := range tests {
+		gotTime, gotRoom, found := NextRoomForTime(day, tt.now)
+		if gotTime != tt.wantTime || gotRoom != tt.wantRo || found != tt.found {
+			t.Errorf("NextRoomForTime(%s) = %q, %q, %v, want %q, %q, %v", tt.now.Format("15:04"), gotTime, gotRoom, found, tt.wantTime, tt.wantRo, tt.found)
+		}
+	}
+	if _, _, found := NextRoomForTime(map[string]string{}, at(7, 0)); found {
+		t.Error("NextRoomForTime() of an empty day found a lesson")
+	}
+	if _, _, found := NextRoomForTime(map[string]string{"bad": "A101"}, at(7, 0)); found {
+		t.Error("NextRoomForTime() found a lesson with a bad start time")
+	}
+}
+
+func TestNextSubjectForTime(t *testing.T) {
+	subjects := map[string]string{"07:45": "M", "08:35": "D", "13:00": "Sp"}
+	tests := []struct {
+		now   time.Time
+		want  string
+		found bool
+	}{
+		{at(0, 0), "M", true},
+		{at(8, 0), "D", true},
+		{at(12, 59), "Sp", true},
+		{at(13, 0), "", false},
+		{at(12, 59).Add(59 * time.Second), "Sp", true}, // seconds do not count
+	}
+	for _, tt := range tests {
+		got, found := NextSubjectForTime(subjects, tt.now)
+		if got != tt.want || found != tt.found {
+			t.Errorf("NextSubjectForTime(%s) = %q, %v, want %q, %v", tt.now.Format("15:04:05"), got, found, tt.want, tt.found)
+		}
+	}
+}
+
+func TestNextCodeForTime(t *testing.T) {
+	codes := map[string]string{"08:35": "cancelled", "13:00": "irregular"}
+	tests := []struct {
+		now   time.Time
+		want  string
+		found bool
+	}{
+		{at(7, 0), "cancelled", true},
+		{at(8, 35), "irregular", true},
+		{at(14, 0), "", false},
+	}
+	for _, tt := range tests {
+		got, found := NextCodeForTime(codes, tt.now)
+		if got != tt.want || found != tt.found {
+			t.Errorf("NextCodeForTime(%s) = %q, %v, want %q, %v", tt.now.Format("15:04"), got, found, tt.want, tt.found)
+		}
+	}
+}
+
+func TestIsScheduledTime(t *testing.T) {
+	conf = Config.Default()
+	conf.Schedule.LessonTimes = []string{"07:45", "13:45"}
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		{at(7, 45), true},
+		{at(7, 45).Add(30 * time.Second), true},
+		{at(13, 44), false},
+		{at(13, 45), true},
+		{at(13, 46), false},
+	}
+	for _, tt := range tests {
+		if got := isScheduledTime(tt.now); got != tt.want {
+			t.Errorf("isScheduledTime(%s) = %v, want %v", tt.now.Format("15:04:05"), got, tt.want)
+		}
+	}
+}
+
+func TestMapTime(t *testing.T) {
+	table := []NamedTimetableEntry{
+		{StartTime: "07:45", Su: []string{"M"}, Ro: []string{"A101", "A102"}},
+		{StartTime: "08:35", Su: []string{"D"}, Ro: []string{"B202"}, Code: "cancelled"},
+		{StartTime: "08:35", Su: []string{"E"}, Ro: []string{"B203"}, Code: "irregular"},
+		{StartTime: "09:35"},
+	}
+	if got, want := MapTimeToRoom(table), map[string]string{"07:45": "A101", "08:35": "B203"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MapTimeToRoom() = %v, want %v", got, want)
+	}
+	if got, want := MapTimeToSubject(table), map[string]string{"07:45": "M", "08:35": "E"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MapTimeToSubject() = %v, want %v", got, want)
+	}
+	// the first code of a start time wins, so a cancellation is not hidden
+	if got, want := MapTimeToCode(table), map[string]string{"08:35": "cancelled"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MapTimeToCode() = %v, want %v", got, want)
+	}
+}
+
+// TestLessonTimeOnFriday runs the minute ticker on a fake clock from 13:44 on
+// a Friday over the lesson time 13:45
+func TestLessonTimeOnFriday(t *testing.T) {
+	var err error
+	db, err = Store.Open("json", "", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf = Config.Default()
+	conf.Schedule.LessonTimes = []string{"13:45"}
+	conf.Notifiers.DryRun = true
+	today := at(0, 0).Format("02-01-2006")
+	err = db.SaveTimetable(Store.MainAccount, []NamedTimetableEntry{
+		{Date: today, StartTime: "13:45", Su: []string{"M"}, Ro: []string{"A101"}},
+		{Date: today, StartTime: "14:25", Su: []string{"D"}, Ro: []string{"B202"}, Code: "cancelled"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	Notify.DryRun(&out)
+	fake := Clock.NewFake(at(13, 44).Add(30 * time.Second))
+	useClock(fake)
+	t.Cleanup(func() {
+		Notify.DryRun(nil)
+		useClock(Clock.Real)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var ticks []string
+	startMinuteTicker(ctx, func(now time.Time) {
+		ticks = append(ticks, now.Format("15:04:05"))
+		if isScheduledTime(now) {
+			Run(now)
+		}
+	})
+	fake.Waiting(1)
+	if out.Len() != 0 {
+		t.Errorf("posted before the lesson time: %q", out.String())
+	}
+	fake.Advance(30 * time.Second) // 13:45
+	fake.Waiting(1)
+	want := "[dry run] webhook: Subject: D\nRoom: B202\nStart-Time: 14:25\nStatus: cancelled"
+	if got := out.String(); !strings.Contains(got, want) || strings.Count(got, "[dry run]") != 1 {
+		t.Errorf("at 13:45 posted %q, want %q", got, want)
+	}
+	fake.Advance(time.Minute) // 13:46
+	fake.Waiting(1)
+	if n := strings.Count(out.String(), "[dry run]"); n != 1 {
+		t.Errorf("%d posts after 13:46, want 1", n)
+	}
+	cancel()
+	loops.Wait()
+	if want := []string{"13:45:00", "13:46:00"}; !reflect.DeepEqual(ticks, want) {
+		t.Errorf("ticked at %v, want %v", ticks, want)
+	}
+}
+
+// webhookReceiver stands in for Discord and keeps the messages posted to it
+type webhookReceiver struct {
+	mutex    sync.Mutex
+	messages []string
+	received chan struct{}
+}
+
+func (w *webhookReceiver) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var payload DiscordWebhookPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.mutex.Lock()
+	w.messages = append(w.messages, payload.Content)
+	w.mutex.Unlock()
+	w.received <- struct{}{}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (w *webhookReceiver) wait(t *testing.T) string {
+	t.Helper()
+	select {
+	case <-w.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook message received")
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.messages[len(w.messages)-1]
+}
+
+// TestPipeline runs fetch, resolve, diff and notify of the main account
+// against the fake Untis server and a fake Discord webhook
+func TestPipeline(t *testing.T) {
+	start := time.Now()
+	fake := Clock.NewFake(start) // the bot and the fake Untis server share it
+	useClock(fake)
+	defer useClock(Clock.Real)
+
+	fixtures := Mock.Default()
+	every := []int{1, 2, 3, 4, 5, 6, 7}
+	fixtures.Holidays = nil
+	fixtures.Lessons = []Mock.Lesson{
+		{ID: 1, Weekdays: every, StartTime: 745, EndTime: 830, Kl: []int{1}, Su: []int{1}, Ro: []int{1}},
+		{ID: 2, Weekdays: every, StartTime: 835, EndTime: 920, Kl: []int{1}, Su: []int{2}, Ro: []int{2}},
+	}
+	fixtures.Changes = []Mock.Change{{After: Mock.Duration(5 * time.Minute), Lesson: 1, Date: "today", Code: "cancelled"}}
+	untis := httptest.NewServer(Mock.New(fixtures, fake.Now))
+	defer untis.Close()
+	oldURL := Untis.Url
+	Untis.Url = untis.URL + "/WebUntis/jsonrpc.do?school=Demo"
+	defer func() { Untis.Url = oldURL }()
+
+	receiver := &webhookReceiver{received: make(chan struct{}, 10)}
+	discord := httptest.NewServer(receiver)
+	defer discord.Close()
+	oldWebhook := discordWebhookURL
+	discordWebhookURL = discord.URL + "/api/webhooks/1/token"
+	defer func() { discordWebhookURL = oldWebhook }()
+
+	var err error
+	db, err = Store.Open("json", "", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf = Config.Default()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	Notify.Register("webhook", deliverWebhook)
+	Notify.Start(ctx, db, Config.QuietHours{})
+
+	creds := Untis.Credentials{User: "demo", Password: "demo-password"}
+
+	// the first fetch has nothing to compare with
+	if n := checkMainTimetable(ctx, creds); n != 0 {
+		t.Errorf("first fetch found %d changes", n)
+	}
+	entries, err := db.Timetable(Store.MainAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	today := start.Format("02-01-2006")
+	var found bool
+	for _, e := range entries {
+		if e.Date == today && e.StartTime == "07:45" {
+			found = true
+			if !reflect.DeepEqual(e.Su, []string{"M"}) || e.Code != "" {
+				t.Errorf("first lesson today is %+v, want M", e)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("no lesson today at 07:45 in %+v", entries)
+	}
+
+	// nothing changed, nothing is posted
+	if n := checkMainTimetable(ctx, creds); n != 0 {
+		t.Errorf("%d changes without a change on the server", n)
+	}
+
+	// the scripted cancellation shows up in the history and on Discord
+	fake.Advance(6 * time.Minute)
+	if n := checkMainTimetable(ctx, creds); n != 1 {
+		t.Errorf("the cancellation was %d changes", n)
+	}
+	if got := receiver.wait(t); got != "A lesson on your timetable has changed" {
+		t.Errorf("webhook got %q", got)
+	}
+	changes, err := History.Changes(db, Store.MainAccount, start, fake.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Kind != Untis.ChangeCancelled || changes[0].New.Date != today {
+		t.Errorf("History.Changes() = %v, want the first lesson today cancelled", changes)
+	} else if !strings.Contains(changes[0].String(), "cancelled") {
+		t.Errorf("change reads %q", changes[0])
+	}
+
+	select {
+	case <-receiver.received:
+		t.Error("more webhook messages than changes")
+	case <-time.After(100 * time.Millisecond):
+	}
+}